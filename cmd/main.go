@@ -2,11 +2,15 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"strconv"
 
 	"github.com/HikariKnight/ls-iommu/internal/version"
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
 	iommu "github.com/HikariKnight/ls-iommu/pkg/iommu"
 	params "github.com/HikariKnight/ls-iommu/pkg/params"
+	"github.com/HikariKnight/ls-iommu/pkg/quirks"
 )
 
 func main() {
@@ -15,62 +19,122 @@ func main() {
 
 	// Display version and exit if the version flag is present
 	if pArg.Flag["version"] {
-		fmt.Printf("ls-iommu version %s built in Go\n", version.Version)
+		fmt.Printf("ls-iommu version %s built in Go (quirk table version %d)\n", version.Version, quirks.Version())
 		os.Exit(0)
 	}
 
-	// Work with the output depending on arguments given
-	if pArg.Flag["gpu"] {
-		// Get all GPUs (3d controllers are ignored)
-		output := iommu.MatchSubclass(`VGA`, pArg)
-
-		// Get all 3D controllers
-		controller3d := iommu.MatchSubclass(`3D`, pArg)
-		output = append(output, controller3d...)
-
-		// Print the output and exit
-		iommu.PrintOutput(output, pArg)
+	// Run the command if one was given
+	switch pArg.String["command"] {
+	case "find":
+		// Search for the devices and print them with the best matches first
+		output := iommu.FindDevices(pArg.String["target"], pArg)
+		if len(output) == 0 {
+			log.Fatalf("No devices matching %q found", pArg.String["target"])
+		}
+		iommu.PrintLines(output, pArg)
 		os.Exit(0)
 
-	} else if pArg.Flag["usb"] {
-		// Get all USB controllers
-		output := iommu.MatchSubclass(`USB controller`, pArg)
-
-		// Print the output and exit
-		iommu.PrintOutput(output, pArg)
+	case "check":
+		// Check the groups and exit with the worst verdict so scripts can act on it
+		checks, err := iommu.CheckGroups(pArg.String["target"], pArg)
+		errorcheck.ErrorCheck(err)
+		for _, line := range iommu.GenCheckReport(checks) {
+			fmt.Print(line)
+		}
+		os.Exit(iommu.WorstVerdict(checks).ExitCode())
+
+	case "viable":
+		// Check the current driver bindings and exit with an error code if a group is not viable
+		viability, err := iommu.CheckViability(pArg.String["target"], pArg)
+		errorcheck.ErrorCheck(err)
+		for _, line := range iommu.GenViabilityReport(viability) {
+			fmt.Print(line)
+		}
+		os.Exit(iommu.ViabilityExitCode(viability))
+
+	case "explain":
+		// Explain why the devices share the group
+		group, err := strconv.Atoi(pArg.String["target"])
+		errorcheck.ErrorCheck(err)
+		output, err := iommu.ExplainGroup(group)
+		errorcheck.ErrorCheck(err)
+		for _, line := range output {
+			fmt.Print(line)
+		}
 		os.Exit(0)
 
-	} else if pArg.Flag["nic"] {
-		// Get all Ethernet controllers
-		output := iommu.MatchSubclass(`Ethernet controller`, pArg)
+	case "slots":
+		// List the physical slots and root ports, and recommend slots if asked to
+		slots, rootPorts := iommu.GetPhysicalSlots()
+		for _, line := range iommu.GenPhysicalSlots(slots, rootPorts, pArg) {
+			fmt.Print(line)
+		}
+		os.Exit(0)
 
-		// Get all Wi-Fi controllers
-		wifi := iommu.MatchSubclass(`Network controller`, pArg)
-		output = append(output, wifi...)
+	case "reset":
+		// Reset the device and check that it came back
+		output, err := iommu.ResetDevice(pArg.String["target"], pArg.String["method"], pArg.Flag["force"])
+		for _, line := range output {
+			fmt.Print(line)
+		}
+		errorcheck.ErrorCheck(err)
+		os.Exit(0)
 
-		// Print the output and exit
-		iommu.PrintOutput(output, pArg)
+	case "simulate":
+		// Predict the groups with the ACS override variants
+		output, err := iommu.SimulateOverrides(pArg.String["target"], pArg)
+		errorcheck.ErrorCheck(err)
+		for _, line := range output {
+			fmt.Print(line)
+		}
 		os.Exit(0)
+	}
 
-	} else if pArg.Flag["sata"] {
-		// Get all Ethernet controllers
-		output := iommu.MatchSubclass(`SATA controller`, pArg)
+	// Print everything we know about the devices given with --device as PCI addresses and exit
+	if len(pArg.StringList["deviceaddr"]) > 0 {
+		for i, address := range pArg.StringList["deviceaddr"] {
+			// Exit with an error if the device does not exist
+			output, err := iommu.GetDeviceDetails(address, pArg)
+			errorcheck.ErrorCheck(err)
+
+			// Separate the devices with an empty line
+			if i > 0 {
+				fmt.Println()
+			}
+			for _, line := range output {
+				fmt.Print(line)
+			}
+		}
+		os.Exit(0)
+	}
 
-		// Print the output and exit
+	// Print the IOMMU group entries of the devices behind the device nodes and names given with --of and exit
+	if len(pArg.StringList["of"]) > 0 {
+		output := iommu.GetDevicesOf(pArg.StringList["of"], pArg)
 		iommu.PrintOutput(output, pArg)
 		os.Exit(0)
+	}
 
-	} else if pArg.Flag["nvme"] {
-		// Get all Ethernet controllers
-		output := iommu.MatchSubclass(`Non-Volatile memory controller`, pArg)
+	// List all device classes and exit if the list-classes flag is present
+	if pArg.Flag["listclasses"] {
+		for _, line := range iommu.ListClasses(pArg) {
+			fmt.Print(line)
+		}
+		os.Exit(0)
+	}
 
-		// Print the output and exit
-		iommu.PrintOutput(output, pArg)
+	// Show the selected devices by slot and exit if the by-slot flag is present
+	if pArg.Flag["byslot"] {
+		for _, line := range iommu.GenSlotView(iommu.GetSlots(pArg)) {
+			fmt.Print(line)
+		}
 		os.Exit(0)
+	}
 
-	} else if pArg.Flag["audio"] {
-		// Get all Ethernet controllers
-		output := iommu.MatchSubclass(`Audio device`, pArg)
+	// Work with the output depending on arguments given
+	if iommu.HasSelector(pArg) {
+		// Get the devices for every selector given (-g -u -n etc) as one list
+		output := iommu.MatchSelectors(pArg)
 
 		// Print the output and exit
 		iommu.PrintOutput(output, pArg)
@@ -0,0 +1,255 @@
+package iommu
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	Access Control Services (ACS) decide if a PCIe port or multi-function device
+	keeps the devices below it from talking to each other without going through
+	the IOMMU. Devices that are not isolated by ACS end up in the same IOMMU group.
+
+	The checks mirror the ones the kernel does when it builds the IOMMU groups
+	(pci_acs_enabled() and pci_acs_path_enabled() in drivers/pci/pci.c),
+	except for the device specific quirks the kernel has for some chipsets
+*/
+
+// Offsets in the ACS extended capability
+const (
+	acsCapability = 0x04
+	acsControl    = 0x06
+)
+
+// ACS capability and control bits
+const (
+	acsSourceValidation   = 0x0001
+	acsTranslationBlock   = 0x0002
+	acsRequestRedirect    = 0x0004
+	acsCompletionRedirect = 0x0008
+	acsUpstreamForwarding = 0x0010
+	acsEgressControl      = 0x0020
+	acsDirectTranslated   = 0x0040
+
+	// The ACS bits the kernel needs to consider a device isolated
+	acsRequired = acsSourceValidation | acsRequestRedirect | acsCompletionRedirect | acsUpstreamForwarding
+)
+
+// The names of the ACS bits, the same ones lspci uses
+var acsFlagNames = []struct {
+	flag uint16
+	name string
+}{
+	{acsSourceValidation, "SrcValid"},
+	{acsTranslationBlock, "TransBlk"},
+	{acsRequestRedirect, "ReqRedir"},
+	{acsCompletionRedirect, "CmpltRedir"},
+	{acsUpstreamForwarding, "UpstreamFwd"},
+	{acsEgressControl, "EgressCtrl"},
+	{acsDirectTranslated, "DirectTrans"},
+}
+
+// The ACS state of a device
+type acsStatus struct {
+	Address string
+	// Vendor ID and Device ID (ex: 8086:1901)
+	ID string
+	// If the config space past the header could be read (needs root)
+	Readable      bool
+	PCIeType      int
+	MultiFunction bool
+	HasACS        bool
+	Capability    uint16
+	Control       uint16
+	// If an ACS override makes the device count as isolating
+	Overridden bool
+}
+
+// Reads the ACS state of a device from its config space
+func getACSStatus(address string) *acsStatus {
+	config := readConfig(address)
+	status := &acsStatus{
+		Address:  address,
+		Readable: len(config) > 0x40,
+		PCIeType: -1,
+	}
+
+	if len(config) > configHeaderType {
+		status.ID = fmt.Sprintf("%04x:%04x", readConfig16(config, 0), readConfig16(config, 2))
+		status.MultiFunction = config[configHeaderType]&headerTypeMultiFunction != 0
+	}
+
+	if offset := findCapability(config, capIDPCIe); offset != 0 {
+		status.PCIeType = int(readConfig16(config, offset+2)>>4) & 0xf
+	}
+
+	if offset := findExtCapability(config, extCapIDACS); offset != 0 {
+		status.HasACS = true
+		status.Capability = readConfig16(config, offset+acsCapability)
+		status.Control = readConfig16(config, offset+acsControl)
+	}
+
+	return status
+}
+
+// Returns the required ACS bits that are not enabled. Bits missing from the capability are hard-wired,
+// so they count as enabled, except for egress control
+func (s *acsStatus) missingFlags() uint16 {
+	if !s.HasACS {
+		return acsRequired
+	}
+	required := uint16(acsRequired) & (s.Capability | acsEgressControl)
+
+	return required &^ s.Control
+}
+
+// Checks if the device keeps the devices below it, or its other functions, isolated from each other
+func (s *acsStatus) isolates() bool {
+	if s.Overridden {
+		return true
+	}
+	if !s.Readable || s.PCIeType < 0 {
+		return false
+	}
+
+	switch s.PCIeType {
+	case pcieTypePCIeToPCI, pcieTypePCIToPCIe, pcieTypeRCEventCollect:
+		return false
+	case pcieTypeRootPort, pcieTypeDownstream:
+		return s.missingFlags() == 0
+	case pcieTypeEndpoint, pcieTypeUpstream, pcieTypeLegacyEndpoint, pcieTypeRCEndpoint:
+		// ACS only matters for these if they have multiple functions
+		if s.MultiFunction {
+			return s.missingFlags() == 0
+		}
+	}
+
+	return true
+}
+
+// Explains why the device does not isolate, returns an empty string if it does
+func (s *acsStatus) reason() string {
+	switch {
+	case s.isolates():
+		return ""
+	case !s.Readable:
+		return "the config space can not be read, run ls-iommu as root"
+	case s.PCIeType < 0:
+		return "it is a conventional PCI device which can not isolate anything"
+	case s.PCIeType == pcieTypePCIeToPCI:
+		return "it is a PCIe to PCI bridge, the devices behind it can not be told apart"
+	case s.PCIeType == pcieTypePCIToPCIe:
+		return "it is a PCI to PCIe bridge which can not isolate anything"
+	case s.PCIeType == pcieTypeRCEventCollect:
+		return "it is a root complex event collector which can not isolate anything"
+	case !s.HasACS:
+		return "it has no ACS capability"
+	}
+
+	return fmt.Sprintf("ACS %s is not enabled", strings.Join(acsFlagList(s.missingFlags()), ", "))
+}
+
+// Describes the ACS state the same way lspci does (ex: ACSCtl: SrcValid+ TransBlk- ...)
+func (s *acsStatus) describe() string {
+	switch {
+	case !s.Readable:
+		return "config space not readable (needs root)"
+	case s.PCIeType < 0:
+		return "conventional PCI"
+	case !s.HasACS:
+		return "no ACS capability"
+	}
+
+	var flags []string
+	for _, flag := range acsFlagNames {
+		state := "-"
+		if s.Control&flag.flag != 0 {
+			state = "+"
+		}
+		flags = append(flags, flag.name+state)
+	}
+
+	return fmt.Sprintf("ACSCtl: %s", strings.Join(flags, " "))
+}
+
+// Returns the names of the ACS bits that are set
+func acsFlagList(flags uint16) []string {
+	var names []string
+	for _, flag := range acsFlagNames {
+		if flags&flag.flag != 0 {
+			names = append(names, flag.name)
+		}
+	}
+
+	return names
+}
+
+// Returns the name of a PCIe device/port type
+func pcieTypeName(pcieType int) string {
+	switch pcieType {
+	case pcieTypeEndpoint:
+		return "Endpoint"
+	case pcieTypeLegacyEndpoint:
+		return "Legacy Endpoint"
+	case pcieTypeRootPort:
+		return "Root Port"
+	case pcieTypeUpstream:
+		return "Switch Upstream Port"
+	case pcieTypeDownstream:
+		return "Switch Downstream Port"
+	case pcieTypePCIeToPCI:
+		return "PCIe to PCI Bridge"
+	case pcieTypePCIToPCIe:
+		return "PCI to PCIe Bridge"
+	case pcieTypeRCEndpoint:
+		return "Root Complex Integrated Endpoint"
+	case pcieTypeRCEventCollect:
+		return "Root Complex Event Collector"
+	case -1:
+		return "PCI"
+	}
+
+	return fmt.Sprintf("PCIe type %d", pcieType)
+}
+
+// Finds the bridge above a device whose group the device joins, and the bridges on the path that do not isolate.
+// The bridges are given and returned closest to the root first, the bridge is nil if the path isolates the device
+func findGroupingBridge(bridges []*acsStatus) (*acsStatus, []*acsStatus) {
+	var anchor *acsStatus
+	var culprits []*acsStatus
+
+	// Like the kernel, go up from the device until the path from a bridge to the root complex is isolated
+	for i := len(bridges) - 1; i >= 0; i-- {
+		if acsPathIsolates(bridges[:i+1]) {
+			break
+		}
+		anchor = bridges[i]
+	}
+
+	if anchor == nil {
+		return nil, culprits
+	}
+
+	// The bridges between the root complex and the anchor that do not isolate are to blame
+	for _, bridge := range bridges {
+		if !bridge.isolates() {
+			culprits = append(culprits, bridge)
+		}
+		if bridge == anchor {
+			break
+		}
+	}
+
+	return anchor, culprits
+}
+
+// Checks if every bridge on a path to the root complex isolates
+func acsPathIsolates(bridges []*acsStatus) bool {
+	for _, bridge := range bridges {
+		if !bridge.isolates() {
+			return false
+		}
+	}
+
+	return true
+}
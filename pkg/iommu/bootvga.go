@@ -0,0 +1,217 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+/*
+	The GPU the firmware initialised (boot VGA) is used by the host before any
+	GPU driver loads: a framebuffer driver (efifb, vesafb, simpledrm) holds its
+	memory and the console is bound to that framebuffer. Passing it through needs
+	the host to let go of it first, which is a different procedure than for a
+	secondary GPU
+*/
+
+// The names framebuffer drivers claim memory with in /proc/iomem
+var framebufferNames = []string{"efifb", "vesafb", "simplefb", "simple-framebuffer", "simpledrm", "BOOTFB", "vesa-framebuffer"}
+
+// If we already warned about the primary GPU, we only do it once
+var warnedBootVGA = false
+
+// What the host uses the boot VGA device for
+type BootVGAInfo struct {
+	// The framebuffer drivers holding the memory of the GPU (ex: efifb (e0000000-e07fffff))
+	Framebuffers []string
+	// If the addresses in /proc/iomem could be read (needs root)
+	Readable bool
+	// The consoles that are bound (ex: (M) frame buffer device)
+	Consoles []string
+	// The boot arguments that keep framebuffer drivers away from the GPU (ex: video=efifb:off)
+	Args []string
+}
+
+// Checks if the firmware initialised the device as the primary GPU
+func isBootVGA(address string) bool {
+	return readDeviceAttr(address, "boot_vga") == "1"
+}
+
+// Gets what the host uses the boot VGA device for
+func getBootVGAInfo(address string) *BootVGAInfo {
+	info := &BootVGAInfo{}
+	info.Framebuffers, info.Readable = getFramebufferClaims(address)
+	info.Consoles = getBoundConsoles()
+	info.Args = getFramebufferArgs()
+
+	return info
+}
+
+// Gets the framebuffer drivers that claim memory inside the BARs of a device from /proc/iomem.
+// Without root every address in /proc/iomem is 0, in that case false is returned
+func getFramebufferClaims(address string) ([]string, bool) {
+	claims := []string{}
+
+	// Every line of the resource file is the start, end and flags of a BAR
+	type memRange struct{ start, end uint64 }
+	var bars []memRange
+	for _, line := range strings.Split(readDeviceAttr(address, "resource"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		start, _ := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		end, _ := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if start != 0 {
+			bars = append(bars, memRange{start, end})
+		}
+	}
+
+	// Every line of /proc/iomem is in the form "start-end : name", indented below the range it is in
+	readable := false
+	for _, line := range strings.Split(readFile("/proc/iomem"), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " : ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		bounds := strings.SplitN(parts[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		start, _ := strconv.ParseUint(bounds[0], 16, 64)
+		end, _ := strconv.ParseUint(bounds[1], 16, 64)
+		if end != 0 {
+			readable = true
+		}
+
+		if !isFramebufferName(parts[1]) {
+			continue
+		}
+		for _, bar := range bars {
+			if start <= bar.end && end >= bar.start {
+				claims = append(claims, fmt.Sprintf("%s (%s)", parts[1], parts[0]))
+				break
+			}
+		}
+	}
+
+	return claims, readable
+}
+
+// Checks if a name in /proc/iomem belongs to a framebuffer driver
+func isFramebufferName(name string) bool {
+	for _, framebuffer := range framebufferNames {
+		if strings.HasPrefix(name, framebuffer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gets the consoles that are bound to a driver, the dummy console does not use any GPU
+func getBoundConsoles() []string {
+	consoles := []string{}
+
+	files, _ := filepath.Glob("/sys/class/vtconsole/vtcon*/bind")
+	for _, file := range files {
+		if strings.TrimSpace(readFile(file)) != "1" {
+			continue
+		}
+		name := strings.TrimSpace(readFile(filepath.Join(filepath.Dir(file), "name")))
+		if !strings.Contains(name, "dummy") {
+			consoles = append(consoles, fmt.Sprintf("%s (%s)", name, filepath.Base(filepath.Dir(file))))
+		}
+	}
+
+	return consoles
+}
+
+// Gets the boot arguments that keep framebuffer drivers away from the boot VGA device
+func getFramebufferArgs() []string {
+	args := []string{}
+
+	for _, arg := range strings.Fields(readFile("/proc/cmdline")) {
+		switch {
+		case strings.HasPrefix(arg, "video=") && strings.HasSuffix(arg, ":off"),
+			strings.HasPrefix(arg, "initcall_blacklist=") && strings.Contains(arg, "sysfb_init"),
+			arg == "nofb",
+			arg == "nomodeset":
+			args = append(args, arg)
+		}
+	}
+
+	return args
+}
+
+// Generates the boot VGA info shown with -k, nothing is shown for devices that are not the boot VGA device
+func genBootVGAInfo(address string) string {
+	if !isBootVGA(address) {
+		return ""
+	}
+	info := getBootVGAInfo(address)
+
+	line := "\tBoot VGA: yes, the firmware initialised this GPU as the primary GPU\n"
+	switch {
+	case !info.Readable:
+		line = fmt.Sprintf("%s\tFramebuffer: unknown (run ls-iommu as root)\n", line)
+	case len(info.Framebuffers) == 0:
+		line = fmt.Sprintf("%s\tFramebuffer: none\n", line)
+	default:
+		line = fmt.Sprintf("%s\tFramebuffer: %s\n", line, strings.Join(info.Framebuffers, ", "))
+	}
+	line = fmt.Sprintf("%s\tBound consoles: %s\n", line, listOrNone(info.Consoles))
+	line = fmt.Sprintf("%s\tFramebuffer boot arguments: %s\n", line, listOrNone(info.Args))
+
+	return line
+}
+
+// Joins a list for the output, or returns none if it is empty
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+
+	return strings.Join(list, ", ")
+}
+
+// Warns on STDERR when the user selects the primary GPU for passthrough, so it does not end up in the output
+func warnBootVGA(device *ghwpci.Device, pArg *params.Params) {
+	if warnedBootVGA || !isBootVGA(device.Address) || !isPassthroughSelection(pArg) {
+		return
+	}
+	warnedBootVGA = true
+	info := getBootVGAInfo(device.Address)
+
+	fmt.Fprintf(os.Stderr, "Warning: %s is the primary GPU, the firmware initialised it and the host uses it for its console.\n", device.Address)
+	fmt.Fprintln(os.Stderr, "The host has to let go of it before it can be passed through:")
+	if len(info.Framebuffers) > 0 {
+		fmt.Fprintf(os.Stderr, "\t%s holds its memory\n", strings.Join(info.Framebuffers, ", "))
+	}
+	for _, console := range info.Consoles {
+		fmt.Fprintf(os.Stderr, "\tthe console %s is bound, unbind it by writing 0 to its bind file in /sys/class/vtconsole\n", console)
+	}
+	if len(info.Args) == 0 {
+		fmt.Fprintln(os.Stderr, "\tadd video=efifb:off video=vesafb:off (or initcall_blacklist=sysfb_init for simpledrm) to the boot arguments")
+	}
+	fmt.Fprintln(os.Stderr, "Or select another GPU as the primary GPU in the UEFI/BIOS.")
+	fmt.Fprintln(os.Stderr)
+}
+
+// Checks if the devices selected are meant for passthrough: printed with --id or --pciaddr for the VFIO config,
+// or checked with check or viable. Listing devices or checking every group is not selecting them
+func isPassthroughSelection(pArg *params.Params) bool {
+	switch pArg.String["command"] {
+	case "check", "viable":
+		return pArg.String["target"] != "" || HasSelector(pArg) || len(pArg.IntList["iommu_group"]) > 0
+	case "", "find":
+		return pArg.Flag["id"] || pArg.Flag["pciaddr"]
+	}
+
+	return false
+}
@@ -0,0 +1,281 @@
+package iommu
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// How well a device can be passed through on its own
+type Verdict int
+
+const (
+	// No other devices (except bridges) are in the IOMMU group
+	VerdictIsolated Verdict = iota
+	// The only other devices in the IOMMU group are functions of the same slot
+	VerdictOwnFunctions
+	// Devices in other slots are in the IOMMU group and have to be passed through as well
+	VerdictUnrelated
+)
+
+// Exit codes for the check command, the worst verdict decides the exit code
+const (
+	ExitIsolated     = 0
+	ExitOwnFunctions = 2
+	ExitUnrelated    = 3
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictOwnFunctions:
+		return "shares with own functions only"
+	case VerdictUnrelated:
+		return "shares with unrelated devices"
+	default:
+		return "isolated"
+	}
+}
+
+// Returns the exit code for the verdict
+func (v Verdict) ExitCode() int {
+	switch v {
+	case VerdictOwnFunctions:
+		return ExitOwnFunctions
+	case VerdictUnrelated:
+		return ExitUnrelated
+	default:
+		return ExitIsolated
+	}
+}
+
+// The result of checking an IOMMU group
+type GroupCheck struct {
+	Group *Group
+	// The devices we want to pass through
+	Targets []*ghwpci.Device
+	// The other functions in the same slots as the targets
+	Functions []*ghwpci.Device
+	// The devices from other slots
+	Unrelated []*ghwpci.Device
+	Verdict   Verdict
+}
+
+// Checks the IOMMU groups of a target, the target can be a PCI address, an IOMMU group number or empty
+// to check the groups given with -i or the groups of the devices selected with the selectors (ex: -g)
+func CheckGroups(target string, pArg *params.Params) ([]*GroupCheck, error) {
+	var checks []*GroupCheck
+
+	alldevs, targets, err := resolveTargets(target, pArg)
+	if err != nil {
+		return checks, err
+	}
+	if len(targets) == 0 {
+		return checks, fmt.Errorf("no devices to check")
+	}
+
+	// Check each group in order
+	for _, id := range sortedGroupIDs(targets) {
+		checks = append(checks, checkGroup(alldevs.Groups[id], targets[id]))
+	}
+
+	return checks, nil
+}
+
+// Finds the devices a command should work on sorted by the IOMMU group they are in. The target can be a PCI address,
+// an IOMMU group number or empty to use the groups given with -i, or the devices matched by the selectors if any.
+// The target devices of a group given by number are the devices in the first slot of the group
+func resolveTargets(target string, pArg *params.Params) (*IOMMU, map[int][]*ghwpci.Device, error) {
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	targets := make(map[int][]*ghwpci.Device)
+	if target != "" {
+		if id, err := strconv.Atoi(target); err == nil {
+			// Check if the IOMMU Group exists
+			group, exists := alldevs.Groups[id]
+			if !exists {
+				return alldevs, targets, fmt.Errorf("IOMMU Group %d does not exist", id)
+			}
+			targets[id] = firstSlotDevices(group)
+
+		} else {
+			// Find the device, PCI addresses can be given without the domain (ex: 01:00.0)
+			group, device := alldevs.FindDevice(normalizeAddress(target))
+			if device == nil {
+				return alldevs, targets, fmt.Errorf("PCI device %s does not exist", normalizeAddress(target))
+			}
+			targets[group.ID] = append(targets[group.ID], device)
+		}
+
+	} else if !HasSelector(pArg) {
+		// Make sure the groups given with -i exist
+		for _, id := range pArg.IntList["iommu_group"] {
+			if _, exists := alldevs.Groups[id]; !exists {
+				return alldevs, targets, fmt.Errorf("IOMMU Group %d does not exist", id)
+			}
+		}
+
+		// Use the groups given with -i, or every group if none were given
+		for id, group := range alldevs.Groups {
+			if isSelectedGroup(id, pArg) {
+				targets[id] = firstSlotDevices(group)
+			}
+		}
+
+	} else {
+		// Use the devices matched by the selectors
+		for id, group := range alldevs.Groups {
+			if !isSelectedGroup(id, pArg) {
+				continue
+			}
+			for _, device := range group.Devices {
+				if matchesSelectors(device, pArg) && filterDevice(group, device, pArg) {
+					targets[id] = append(targets[id], device)
+				}
+			}
+		}
+	}
+
+	// The targets are what the user wants to pass through
+	for _, devices := range targets {
+		for _, device := range devices {
+			warnBootVGA(device, pArg)
+		}
+	}
+
+	return alldevs, targets, nil
+}
+
+// Returns the IOMMU group numbers of the targets in order
+func sortedGroupIDs(targets map[int][]*ghwpci.Device) []int {
+	var ids []int
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// Checks which devices have to be passed through along with the targets, bridges are not counted
+func checkGroup(group *Group, targets []*ghwpci.Device) *GroupCheck {
+	check := &GroupCheck{
+		Group:   group,
+		Targets: sortDevices(targets),
+		Verdict: VerdictIsolated,
+	}
+
+	// Keep track of the targets and their slots
+	isTarget := make(map[string]bool)
+	slots := make(map[string]bool)
+	for _, target := range targets {
+		isTarget[target.Address] = true
+		slots[slotAddress(target.Address)] = true
+	}
+
+	for _, device := range sortDevices(mapDevices(group.Devices)) {
+		if isTarget[device.Address] || isBridge(device) {
+			continue
+		}
+
+		if slots[slotAddress(device.Address)] {
+			check.Functions = append(check.Functions, device)
+			if check.Verdict < VerdictOwnFunctions {
+				check.Verdict = VerdictOwnFunctions
+			}
+		} else {
+			check.Unrelated = append(check.Unrelated, device)
+			check.Verdict = VerdictUnrelated
+		}
+	}
+
+	// Two targets from different slots in the same group are not isolated from each other either
+	if len(slots) > 1 {
+		check.Verdict = VerdictUnrelated
+	}
+
+	return check
+}
+
+// Gets the non bridge devices in the first slot of a group
+func firstSlotDevices(group *Group) []*ghwpci.Device {
+	var devices []*ghwpci.Device
+
+	slot := ""
+	for _, device := range sortDevices(mapDevices(group.Devices)) {
+		if isBridge(device) {
+			continue
+		}
+		if slot == "" {
+			slot = slotAddress(device.Address)
+		}
+		if slotAddress(device.Address) == slot {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+// Generates the report for the checked groups
+func GenCheckReport(checks []*GroupCheck) []string {
+	var lines []string
+
+	for _, check := range checks {
+		lines = append(lines, fmt.Sprintf("%s %d: %s\n", groupLabel(), check.Group.ID, check.Verdict))
+
+		if len(check.Targets) == 0 {
+			lines = append(lines, "\tThe group only contains bridges\n")
+		}
+		for _, device := range check.Targets {
+			lines = append(lines, fmt.Sprintf("\tTarget: %s\n", describeDevice(device)))
+		}
+
+		// List the devices that have to be passed through along with the targets
+		if len(check.Functions) > 0 || len(check.Unrelated) > 0 {
+			lines = append(lines, "\tHas to be passed through along with:\n")
+		}
+		for _, device := range check.Functions {
+			lines = append(lines, fmt.Sprintf("\t\t%s (same slot)\n", describeDevice(device)))
+		}
+		for _, device := range check.Unrelated {
+			lines = append(lines, fmt.Sprintf("\t\t%s (unrelated)\n", describeDevice(device)))
+		}
+	}
+
+	return lines
+}
+
+// Returns the worst verdict of the checked groups
+func WorstVerdict(checks []*GroupCheck) Verdict {
+	worst := VerdictIsolated
+	for _, check := range checks {
+		if check.Verdict > worst {
+			worst = check.Verdict
+		}
+	}
+
+	return worst
+}
+
+// Turns a map of devices into a slice
+func mapDevices(devices map[string]*ghwpci.Device) []*ghwpci.Device {
+	var list []*ghwpci.Device
+	for _, device := range devices {
+		list = append(list, device)
+	}
+
+	return list
+}
+
+// Sorts devices by their PCI address
+func sortDevices(devices []*ghwpci.Device) []*ghwpci.Device {
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Address < devices[j].Address
+	})
+
+	return devices
+}
@@ -0,0 +1,147 @@
+package iommu
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	"github.com/jaypipes/ghw"
+	"github.com/jaypipes/ghw/pkg/pci"
+)
+
+// Regex to check if a --class argument is a class code (class, class+subclass or class+subclass+prog-if)
+var classCodeRegex = regexp.MustCompile(`^([0-9a-f]{2}|[0-9a-f]{4}|[0-9a-f]{6})$`)
+
+// Gets all devices matching the class code or class name given with --class
+func MatchClass(class string, pArg *params.Params) []string {
+	return matchDevices(func(device *pci.Device) bool {
+		return matchesClass(device, class)
+	}, pArg)
+}
+
+// Checks if a device matches a class code (ex: 0c03 or 0c0330) or a class, subclass or prog-if name
+func matchesClass(device *pci.Device, class string) bool {
+	// Normalize the class so 0x0C03 and 0c03 are treated the same
+	search := strings.ToLower(strings.TrimSpace(class))
+	code := strings.TrimPrefix(search, "0x")
+
+	// If we got a class code, compare it against the start of the full class code of the device
+	if classCodeRegex.MatchString(code) {
+		if len(code) == 4 {
+			checkSubclassCode(code)
+		}
+		return strings.HasPrefix(deviceClassCode(device), code)
+	}
+
+	// Else do a case insensitive search on the class, subclass and prog-if names
+	for _, name := range []string{
+		device.Class.Name,
+		device.Subclass.Name,
+		device.ProgrammingInterface.Name,
+	} {
+		if strings.Contains(strings.ToLower(name), search) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The class and subclass codes in the pci.ids database and of the devices on this host (ex: 0c03),
+// loaded the first time they are needed
+var knownSubclasses map[string]bool
+
+// Exits with an error if a 4 digit class code is not a class and subclass in the pci.ids database.
+// Vendor IDs are 4 digits as well, so 8086 would otherwise silently be matched as class 80 subclass 86
+func checkSubclassCode(code string) {
+	if knownSubclasses == nil {
+		knownSubclasses = make(map[string]bool)
+		pci, err := ghw.PCI(ghw.WithDisableWarnings())
+		errorcheck.ErrorCheck(err, "Failed to parse PCI devices")
+		for _, class := range pci.Classes {
+			for _, subclass := range class.Subclasses {
+				knownSubclasses[strings.ToLower(class.ID+subclass.ID)] = true
+			}
+		}
+
+		// An old database can miss classes the devices on this host use
+		for _, device := range pci.Devices {
+			if code := deviceClassCode(device); len(code) >= 4 {
+				knownSubclasses[code[:4]] = true
+			}
+		}
+	}
+
+	// Without a database we can not tell, so we trust the user
+	if len(knownSubclasses) > 0 && !knownSubclasses[code] {
+		errorcheck.ErrorCheck(fmt.Errorf(
+			"%s is not a known class and subclass code, to match a Vendor ID use --vendor %s or %s:<device id>",
+			code, code, code,
+		))
+	}
+}
+
+// Returns the full class code of a device as class+subclass+prog-if (ex: 0c0330)
+func deviceClassCode(device *pci.Device) string {
+	return strings.ToLower(fmt.Sprintf(
+		"%s%s%s",
+		device.Class.ID,
+		device.Subclass.ID,
+		device.ProgrammingInterface.ID,
+	))
+}
+
+// Generates a list of every device class present on this host and how many devices belong to them, filters are applied
+func ListClasses(pArg *params.Params) []string {
+	var lines []string
+
+	// Get all PCI devices
+	pci, err := ghw.PCI(ghw.WithDisableWarnings())
+	errorcheck.ErrorCheck(err, "Failed to parse PCI devices")
+
+	// Count the devices for each class, subclass and prog-if code and keep track of their names
+	counts := make(map[string]int)
+	names := make(map[string]string)
+	for _, device := range pci.Devices {
+		// Skip devices that do not pass the filters
+		if !filterDevice(nil, device, pArg) {
+			continue
+		}
+
+		code := deviceClassCode(device)
+
+		counts[code[:2]]++
+		names[code[:2]] = device.Class.Name
+		counts[code[:4]]++
+		names[code[:4]] = device.Subclass.Name
+
+		// Only list the prog-if if it is known to the pci.ids database
+		if device.ProgrammingInterface.Name != "unknown" {
+			counts[code]++
+			names[code] = device.ProgrammingInterface.Name
+		}
+	}
+
+	// Sort the codes so every subclass ends up below its class
+	var codes []string
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	// Generate a line for each code, indented by how deep it is
+	for _, code := range codes {
+		lines = append(lines, fmt.Sprintf(
+			"%s[%s] %s: %d\n",
+			strings.Repeat("\t", len(code)/2-1),
+			code,
+			names[code],
+			counts[code],
+		))
+	}
+
+	return lines
+}
@@ -0,0 +1,146 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+	Helpers for reading the PCI config space of devices through sysfs
+
+	Only the first 64 bytes of the config space can be read without root,
+	anything past that (like the capabilities) needs ls-iommu to run as root
+*/
+
+// Offsets and values in the PCI config space header
+const (
+	configStatus     = 0x06
+	configHeaderType = 0x0e
+	configCapPointer = 0x34
+
+	// The extended capabilities of PCIe devices start after the first 256 bytes
+	configExtCapStart = 0x100
+
+	// Set in the status register if the device has a capability list
+	statusCapList = 0x10
+
+	// Set in the header type if the device has multiple functions
+	headerTypeMultiFunction = 0x80
+
+	// Header types (with the multi-function bit masked out)
+	headerTypeNormal  = 0x00
+	headerTypeBridge  = 0x01
+	headerTypeCardBus = 0x02
+)
+
+// Capability IDs
+const (
+	capIDPCIe = 0x10
+)
+
+// Extended capability IDs
+const (
+	extCapIDACS = 0x000d
+)
+
+// PCIe device/port types from the PCIe capability
+const (
+	pcieTypeEndpoint       = 0x0
+	pcieTypeLegacyEndpoint = 0x1
+	pcieTypeRootPort       = 0x4
+	pcieTypeUpstream       = 0x5
+	pcieTypeDownstream     = 0x6
+	pcieTypePCIeToPCI      = 0x7
+	pcieTypePCIToPCIe      = 0x8
+	pcieTypeRCEndpoint     = 0x9
+	pcieTypeRCEventCollect = 0xa
+)
+
+// Reads the config space of a PCI device, returns nil if it can not be read
+func readConfig(address string) []byte {
+	config, err := os.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/config", address))
+	if err != nil {
+		return nil
+	}
+
+	return config
+}
+
+// Gets the header type of a PCI device with the multi-function bit masked out, returns -1 if it can not be read
+func getHeaderType(address string) int {
+	config := readConfig(address)
+	if len(config) <= configHeaderType {
+		return -1
+	}
+
+	return int(config[configHeaderType] & 0x7f)
+}
+
+// Finds a capability in the config space, returns the offset of the capability or 0 if it was not found
+func findCapability(config []byte, id byte) int {
+	// The device has to have a capability list and we need to be able to read past the header
+	if len(config) <= configCapPointer || config[configStatus]&statusCapList == 0 {
+		return 0
+	}
+
+	// Walk the capability list, each capability is [id, next pointer, ...]
+	// We stop after 48 capabilities in case the list loops
+	offset := int(config[configCapPointer] & 0xfc)
+	for i := 0; i < 48 && offset >= 0x40 && offset+1 < len(config); i++ {
+		if config[offset] == id {
+			return offset
+		}
+		offset = int(config[offset+1] & 0xfc)
+	}
+
+	return 0
+}
+
+// Finds an extended capability in the config space, returns the offset of the capability or 0 if it was not found
+func findExtCapability(config []byte, id uint16) int {
+	// Walk the extended capability list, each capability starts with [id (16 bits), version (4 bits), next pointer (12 bits)]
+	// We stop after 480 capabilities in case the list loops
+	offset := configExtCapStart
+	for i := 0; i < 480 && offset >= configExtCapStart && offset+3 < len(config); i++ {
+		header := readConfig32(config, offset)
+		if header == 0 || header == 0xffffffff {
+			return 0
+		}
+		if uint16(header&0xffff) == id {
+			return offset
+		}
+		offset = int(header>>20) & 0xffc
+	}
+
+	return 0
+}
+
+// Reads a little endian 16 bit value from the config space, returns 0 if it is out of range
+func readConfig16(config []byte, offset int) uint16 {
+	if offset+1 >= len(config) {
+		return 0
+	}
+
+	return uint16(config[offset]) | uint16(config[offset+1])<<8
+}
+
+// Reads a little endian 32 bit value from the config space, returns 0 if it is out of range
+func readConfig32(config []byte, offset int) uint32 {
+	if offset+3 >= len(config) {
+		return 0
+	}
+
+	return uint32(readConfig16(config, offset)) | uint32(readConfig16(config, offset+2))<<16
+}
+
+// Gets the PCIe device/port type of a device, returns -1 if it is not PCIe or the capabilities can not be read (needs root)
+func getPCIeType(address string) int {
+	config := readConfig(address)
+	offset := findCapability(config, capIDPCIe)
+	if offset == 0 {
+		return -1
+	}
+
+	// The device/port type is in bits 4-7 of the PCIe capabilities register
+	return int(readConfig16(config, offset+2)>>4) & 0xf
+}
@@ -0,0 +1,117 @@
+package iommu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// Generates everything we know about the device at a PCI address, returns an error if the device does not exist
+func GetDeviceDetails(address string, pArg *params.Params) ([]string, error) {
+	var lines []string
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	// Find the device, PCI addresses can be given without the domain (ex: 01:00.0)
+	address = normalizeAddress(address)
+	group, device := alldevs.FindDevice(address)
+	if device == nil {
+		return lines, fmt.Errorf("PCI device %s does not exist", address)
+	}
+
+	// Start with the same line we would list the device with
+	lines = append(lines, GenDeviceLine(group.ID, device, pArg))
+
+	// List the other devices in the IOMMU group, they will have to be passed through along with this one
+	lines = append(lines, fmt.Sprintf("\tIOMMU Group: %d\n", group.ID))
+	var mates []string
+	for _, mate := range group.Devices {
+		if mate.Address != device.Address {
+			mates = append(mates, fmt.Sprintf("\t\t%s\n", describeDevice(mate)))
+		}
+	}
+	sort.Strings(mates)
+	if len(mates) == 0 {
+		lines = append(lines, "\tGroup mates: none\n")
+	} else {
+		lines = append(lines, "\tGroup mates:\n")
+		lines = append(lines, mates...)
+	}
+
+	// Class, subclass and programming interface
+	lines = append(lines, fmt.Sprintf(
+		"\tClass: %s [%s], %s [%s%s], prog-if %s [%s]\n",
+		device.Class.Name,
+		device.Class.ID,
+		device.Subclass.Name,
+		device.Class.ID,
+		device.Subclass.ID,
+		device.ProgrammingInterface.Name,
+		device.ProgrammingInterface.ID,
+	))
+
+	// Vendor and device IDs
+	lines = append(lines, fmt.Sprintf("\tVendor: %s [%s]\n", device.Vendor.Name, device.Vendor.ID))
+	lines = append(lines, fmt.Sprintf("\tDevice: %s [%s]\n", device.Product.Name, device.Product.ID))
+	lines = append(lines, fmt.Sprintf("\tRevision: %s\n", strings.TrimPrefix(device.Revision, "0x")))
+
+	// Subsystem and kernel driver, the same info as -k gives us
+	lines = append(lines, GenKernelInfo(group.ID, device))
+	if device.Driver == "" {
+		lines = append(lines, "\tKernel driver in use: none\n")
+	}
+
+	// Kernel modules that can drive the device
+	modules := getKernelModules(device.Address)
+	if len(modules) > 0 {
+		lines = append(lines, fmt.Sprintf("\tKernel modules: %s\n", strings.Join(modules, ", ")))
+	}
+
+	// The rom file of the device if it has one
+	for _, rom := range GetRomPath(device, pArg) {
+		lines = append(lines, fmt.Sprintf("\tROM: %s", rom))
+	}
+
+	// NUMA node
+	if node := getNUMANode(device.Address); node >= 0 {
+		lines = append(lines, fmt.Sprintf("\tNUMA node: %d\n", node))
+	} else {
+		lines = append(lines, "\tNUMA node: none\n")
+	}
+
+	// Bridges between the root complex and the device
+	bridges := getParentBridges(device.Address)
+	if len(bridges) == 0 {
+		lines = append(lines, "\tParent bridges: none (on the root bus)\n")
+	} else {
+		lines = append(lines, "\tParent bridges:\n")
+		for _, bridge := range bridges {
+			if _, parent := alldevs.FindDevice(bridge); parent != nil {
+				lines = append(lines, fmt.Sprintf("\t\t%s\n", describeDevice(parent)))
+			} else {
+				lines = append(lines, fmt.Sprintf("\t\t%s\n", bridge))
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+// Describes a device in one short line (ex: 0000:01:00.1 Audio device [0403]: NVIDIA Corporation ... [10de:228b])
+func describeDevice(device *ghwpci.Device) string {
+	return fmt.Sprintf(
+		"%s %s [%s%s]: %s %s [%s:%s]",
+		device.Address,
+		device.Subclass.Name,
+		device.Class.ID,
+		device.Subclass.ID,
+		device.Vendor.Name,
+		device.Product.Name,
+		device.Vendor.ID,
+		device.Product.ID,
+	)
+}
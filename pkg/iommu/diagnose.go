@@ -0,0 +1,272 @@
+package iommu
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/*
+	Diagnoses why there are no IOMMU groups. The IOMMU needs:
+		- the IOMMU (VT-d/AMD-Vi) enabled in the UEFI/BIOS, which makes the firmware add the DMAR/IVRS table.
+		  Some boards only show the IOMMU option once virtualization (VT-x/SVM) is enabled
+		- a kernel with the IOMMU driver for the CPU vendor built in
+		- intel_iommu=on in the boot arguments on Intel if the kernel does not enable it by default,
+		  and no intel_iommu=off, amd_iommu=off or iommu=off
+*/
+
+// The most kernel log lines we show
+const maxLogLines = 10
+
+// What we found out about why the IOMMU is disabled
+type Diagnosis struct {
+	// Intel, AMD or the vendor string of the CPU
+	CPUVendor string
+	// The virtualization flag of the CPU (vmx or svm), empty if the CPU does not show it
+	VirtFlag string
+	// If we are running in a virtual machine
+	Hypervisor bool
+	// The IOMMU boot arguments (ex: intel_iommu=on)
+	Args []string
+	// DMAR, IVRS or empty if the firmware does not describe an IOMMU
+	Table string
+	// The IOMMU options of the kernel config (ex: CONFIG_INTEL_IOMMU=y), nil if the config can not be found
+	KernelConfig map[string]string
+	// The kernel log lines about the IOMMU (needs root)
+	LogLines []string
+	// The likely cause and what to do about it
+	Cause string
+	Fix   string
+}
+
+// Diagnoses why the IOMMU is disabled
+func DiagnoseIOMMU() *Diagnosis {
+	d := &Diagnosis{
+		Table:        getFirmwareIOMMUTable(),
+		KernelConfig: getKernelIOMMUConfig(),
+		LogLines:     getIOMMULogLines(),
+	}
+	d.readCPUInfo()
+
+	for _, arg := range strings.Fields(readFile("/proc/cmdline")) {
+		for _, prefix := range []string{"intel_iommu=", "amd_iommu=", "iommu="} {
+			if strings.HasPrefix(arg, prefix) {
+				d.Args = append(d.Args, arg)
+			}
+		}
+	}
+
+	d.Cause, d.Fix = d.findCause()
+
+	return d
+}
+
+// Reads the CPU vendor and the virtualization flags from /proc/cpuinfo
+func (d *Diagnosis) readCPUInfo() {
+	d.CPUVendor = "unknown"
+	for _, line := range strings.Split(readFile("/proc/cpuinfo"), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+
+		switch strings.TrimSpace(key) {
+		case "vendor_id":
+			switch value = strings.TrimSpace(value); value {
+			case "GenuineIntel":
+				d.CPUVendor = "Intel"
+			case "AuthenticAMD":
+				d.CPUVendor = "AMD"
+			default:
+				d.CPUVendor = value
+			}
+		case "flags":
+			for _, flag := range strings.Fields(value) {
+				switch flag {
+				case "vmx", "svm":
+					d.VirtFlag = flag
+				case "hypervisor":
+					d.Hypervisor = true
+				}
+			}
+			// Every CPU has the same flags, so the first one is enough
+			return
+		}
+	}
+}
+
+// Checks what the IOMMU is blocked by, the firmware comes first since nothing else matters until it is enabled
+func (d *Diagnosis) findCause() (string, string) {
+	hasArg := func(args ...string) bool {
+		for _, arg := range d.Args {
+			for _, other := range args {
+				if arg == other {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	switch {
+	case d.Hypervisor && d.Table == "":
+		return "ls-iommu is running in a virtual machine that does not have a virtual IOMMU",
+			"Give the virtual machine a virtual IOMMU (ex: -device intel-iommu with QEMU) or run ls-iommu on the host"
+
+	case d.Table == "" && d.VirtFlag == "" && (d.CPUVendor == "Intel" || d.CPUVendor == "AMD"):
+		// Virtualization is not needed for the IOMMU, but if the firmware has neither enabled they are likely both off
+		return "virtualization (VT-x/AMD-V) is disabled in the UEFI/BIOS",
+			"Enable VT-x/SVM and VT-d/AMD-Vi (IOMMU) in the UEFI/BIOS"
+
+	case d.Table == "":
+		return "the IOMMU (VT-d/AMD-Vi) is disabled in the UEFI/BIOS, the firmware does not describe it with a DMAR or IVRS table",
+			"Enable VT-d/AMD-Vi (called IOMMU on some boards) in the UEFI/BIOS"
+
+	case hasArg("intel_iommu=off", "amd_iommu=off", "iommu=off"):
+		return "the IOMMU is turned off in the boot arguments",
+			"Remove intel_iommu=off, amd_iommu=off and iommu=off from the boot arguments"
+
+	case d.Table == "DMAR" && d.KernelConfig != nil && d.KernelConfig["CONFIG_INTEL_IOMMU"] != "y":
+		return "the kernel is built without the Intel IOMMU driver (CONFIG_INTEL_IOMMU)", "Use a kernel built with CONFIG_INTEL_IOMMU=y"
+
+	case d.Table == "IVRS" && d.KernelConfig != nil && d.KernelConfig["CONFIG_AMD_IOMMU"] != "y":
+		return "the kernel is built without the AMD IOMMU driver (CONFIG_AMD_IOMMU)", "Use a kernel built with CONFIG_AMD_IOMMU=y"
+
+	case d.Table == "DMAR" && !hasArg("intel_iommu=on") && d.KernelConfig["CONFIG_INTEL_IOMMU_DEFAULT_ON"] != "y":
+		return "the kernel does not enable the Intel IOMMU by default and intel_iommu=on is not in the boot arguments",
+			"Add intel_iommu=on to the boot arguments"
+	}
+
+	return "unknown, the firmware, the boot arguments and the kernel config look fine", "Check the kernel log lines above for errors"
+}
+
+// Gets the IOMMU options from the kernel config, from /proc/config.gz or /boot/config-<release>.
+// Returns nil if neither exists
+func getKernelIOMMUConfig() map[string]string {
+	var reader io.Reader
+	if file, err := os.Open("/proc/config.gz"); err == nil {
+		defer file.Close()
+		if reader, err = gzip.NewReader(file); err != nil {
+			return nil
+		}
+	} else {
+		release := strings.TrimSpace(readFile("/proc/sys/kernel/osrelease"))
+		file, err := os.Open(fmt.Sprintf("/boot/config-%s", release))
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	// Options that are not set are missing from the map
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if found && strings.Contains(key, "IOMMU") {
+			config[key] = value
+		}
+	}
+
+	return config
+}
+
+// Gets the kernel log lines about the IOMMU from /dev/kmsg (needs root), only the last lines are kept
+func getIOMMULogLines() []string {
+	var lines []string
+
+	// Reading /dev/kmsg blocks at the end of the log unless it is non blocking
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return lines
+	}
+	defer syscall.Close(fd)
+
+	// Every read returns one record in the form "level,sequence,timestamp,flags;message"
+	buffer := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(fd, buffer)
+		if err == syscall.EPIPE {
+			// The record was overwritten while we were reading, just go on
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+
+		_, message, found := strings.Cut(string(buffer[:n]), ";")
+		if !found {
+			continue
+		}
+		message = strings.TrimSpace(strings.SplitN(message, "\n", 2)[0])
+		lower := strings.ToLower(message)
+		for _, keyword := range []string{"iommu", "dmar", "amd-vi", "ivrs"} {
+			if strings.Contains(lower, keyword) {
+				lines = append(lines, message)
+				break
+			}
+		}
+	}
+
+	if len(lines) > maxLogLines {
+		lines = lines[len(lines)-maxLogLines:]
+	}
+
+	return lines
+}
+
+// Generates the diagnosis for the user
+func GenDiagnosis(d *Diagnosis) []string {
+	var lines []string
+
+	virt := "not enabled or not supported"
+	if d.VirtFlag != "" {
+		virt = fmt.Sprintf("enabled (%s)", d.VirtFlag)
+	}
+	cpu := fmt.Sprintf("\tCPU: %s, virtualization %s", d.CPUVendor, virt)
+	if d.Hypervisor {
+		cpu = fmt.Sprintf("%s, running in a virtual machine", cpu)
+	}
+	lines = append(lines, fmt.Sprintf("%s\n", cpu))
+
+	lines = append(lines, fmt.Sprintf("\tBoot arguments: %s\n", listOrNone(d.Args)))
+
+	if d.Table == "" {
+		lines = append(lines, "\tFirmware: no DMAR or IVRS table\n")
+	} else {
+		lines = append(lines, fmt.Sprintf("\tFirmware: %s table found\n", d.Table))
+	}
+
+	if d.KernelConfig == nil {
+		lines = append(lines, "\tKernel config: unknown (no /proc/config.gz or /boot/config-<release>)\n")
+	} else {
+		var options []string
+		for _, option := range []string{"CONFIG_INTEL_IOMMU", "CONFIG_INTEL_IOMMU_DEFAULT_ON", "CONFIG_AMD_IOMMU"} {
+			if value, exists := d.KernelConfig[option]; exists {
+				options = append(options, fmt.Sprintf("%s=%s", option, value))
+			} else {
+				options = append(options, fmt.Sprintf("%s is not set", option))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("\tKernel config: %s\n", strings.Join(options, ", ")))
+	}
+
+	if len(d.LogLines) == 0 {
+		lines = append(lines, "\tKernel log: nothing about the IOMMU (or it can not be read, run ls-iommu as root)\n")
+	} else {
+		lines = append(lines, "\tKernel log:\n")
+		for _, line := range d.LogLines {
+			lines = append(lines, fmt.Sprintf("\t\t%s\n", line))
+		}
+	}
+
+	lines = append(lines, fmt.Sprintf("Likely cause: %s\n", d.Cause))
+	lines = append(lines, fmt.Sprintf("Fix: %s\n", d.Fix))
+
+	return lines
+}
@@ -0,0 +1,98 @@
+package iommu
+
+import (
+	"fmt"
+)
+
+// Explains why the devices in an IOMMU group share it by walking the bridges above every device
+// and checking which of them do not isolate the devices below them with ACS
+func ExplainGroup(id int) ([]string, error) {
+	var lines []string
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	// Check if the IOMMU Group exists
+	group, exists := alldevs.Groups[id]
+	if !exists {
+		return lines, fmt.Errorf("IOMMU Group %d does not exist", id)
+	}
+
+	// Bridges do not have to be passed through, so only the other devices need explaining
+	var devices []string
+	for _, device := range sortDevices(mapDevices(group.Devices)) {
+		if !isBridge(device) {
+			devices = append(devices, device.Address)
+		}
+	}
+
+	// The capabilities are past the part of the config space everyone can read
+	if len(devices) > 0 && !getACSStatus(devices[0]).Readable {
+		return lines, fmt.Errorf("explain needs to read the PCI config space, run ls-iommu as root")
+	}
+
+	lines = append(lines, fmt.Sprintf("%s %d:\n", groupLabel(), id))
+	explained := false
+	for _, address := range devices {
+		lines = append(lines, fmt.Sprintf("\t%s\n", describeDevice(group.Devices[address])))
+
+		// Show the ACS state of every bridge between the root complex and the device
+		var bridges []*acsStatus
+		for _, bridge := range getParentBridges(address) {
+			status := getACSStatus(bridge)
+			bridges = append(bridges, status)
+			lines = append(lines, fmt.Sprintf("\t\t%s %s: %s\n", bridge, pcieTypeName(status.PCIeType), status.describe()))
+		}
+		if len(bridges) == 0 {
+			lines = append(lines, "\t\tOn the root bus, there are no bridges above it\n")
+		}
+
+		// Functions of a multi-function device without ACS share a group
+		isolated := true
+		if status := getACSStatus(address); status.MultiFunction && !status.isolates() && hasOtherFunctions(group, address) {
+			lines = append(lines, fmt.Sprintf(
+				"\t\tShares the group with the other functions of %s, it is a multi-function device and %s\n",
+				slotAddress(address),
+				status.reason(),
+			))
+			isolated = false
+		}
+
+		// A device joins the group of the highest bridge above it that does not have an isolated path to the root complex
+		if anchor, culprits := findGroupingBridge(bridges); anchor != nil {
+			lines = append(lines, fmt.Sprintf("\t\tJoins the group of %s since the devices below it are not isolated:\n", anchor.Address))
+			for _, culprit := range culprits {
+				lines = append(lines, fmt.Sprintf("\t\t\t%s (%s): %s\n", culprit.Address, pcieTypeName(culprit.PCIeType), culprit.reason()))
+			}
+			isolated = false
+		}
+
+		if isolated {
+			lines = append(lines, "\t\tIsolated by the topology\n")
+		} else {
+			explained = true
+		}
+	}
+
+	// Some groups are made by things we can not see in the topology
+	switch {
+	case len(devices) <= 1:
+		lines = append(lines, "\tNothing to explain, there is only one device in the group that is not a bridge\n")
+	case !explained:
+		lines = append(lines, "\tNo missing isolation in the topology explains this group, "+
+			"it is likely caused by a chipset specific quirk, DMA aliases or the firmware tables (DMAR/IVRS)\n")
+	}
+
+	return lines, nil
+}
+
+// Checks if other functions of the same slot as the device are in the group
+func hasOtherFunctions(group *Group, address string) bool {
+	for _, device := range group.Devices {
+		if device.Address != address && slotAddress(device.Address) == slotAddress(address) {
+			return true
+		}
+	}
+
+	return false
+}
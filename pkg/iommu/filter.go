@@ -0,0 +1,199 @@
+package iommu
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	"github.com/HikariKnight/ls-iommu/pkg/where"
+	"github.com/jaypipes/ghw/pkg/pci"
+)
+
+// Parsed --where expressions so we only have to parse them once
+var whereCache = make(map[string]*where.Expr)
+
+// Checks if a device passes the filters given as arguments, returns false if the device should be left out.
+// The group is the IOMMU group the device is in and can be nil if it is unknown
+func filterDevice(group *Group, device *pci.Device, pArg *params.Params) bool {
+	// If we got vendor filters, the device has to match at least one of them
+	if len(pArg.StringList["vendor"]) > 0 && !matchesAnyID(device, pArg.StringList["vendor"]) {
+		return false
+	}
+
+	// If we got device filters, the device has to match at least one of them
+	if len(pArg.StringList["device"]) > 0 && !matchesAnyID(device, pArg.StringList["device"]) {
+		return false
+	}
+
+	// If we got driver filters, the device has to use one of the drivers (or no driver if --no-driver is given)
+	if len(pArg.StringList["driver"]) > 0 || pArg.Flag["nodriver"] {
+		if !matchesAnyDriver(device, pArg.StringList["driver"]) && !(pArg.Flag["nodriver"] && device.Driver == "") {
+			return false
+		}
+	}
+
+	// Devices using any of the drivers given with --not-driver are left out
+	if matchesAnyDriver(device, pArg.StringList["notdriver"]) {
+		return false
+	}
+
+	// Devices matching anything given with --exclude are left out
+	for _, exclude := range pArg.StringList["exclude"] {
+		if matchesExclude(device, exclude) {
+			return false
+		}
+	}
+
+	// Hide or only show bridges if asked to
+	switch pArg.String["bridges"] {
+	case "hide":
+		if isBridge(device) {
+			return false
+		}
+	case "only":
+		if !isBridge(device) {
+			return false
+		}
+	}
+
+	// If we got a --where expression, the device has to match it
+	if pArg.String["where"] != "" && !parseWhere(pArg.String["where"]).Eval(NewRecord(group, device).whereValues()) {
+		return false
+	}
+
+	return true
+}
+
+// Parses a --where expression and exits with a pointer to the error if it is invalid
+func parseWhere(expression string) *where.Expr {
+	// Use the already parsed expression if we have it
+	if expr, exists := whereCache[expression]; exists {
+		return expr
+	}
+
+	expr, err := where.Parse(expression, recordFields)
+	if err != nil {
+		// Point at the column where the error happened
+		column := len(expression)
+		if parseErr, ok := err.(*where.Error); ok {
+			column = parseErr.Column - 1
+		}
+		errorcheck.ErrorCheck(
+			err,
+			"Invalid --where expression:",
+			expression,
+			fmt.Sprintf("%s^", strings.Repeat(" ", column)),
+		)
+	}
+	whereCache[expression] = expr
+
+	return expr
+}
+
+// Checks if a device matches an exclude entry, which can be a PCI address, a VendorID:DeviceID pair,
+// a class code or name, or "bridge" to match every bridge
+func matchesExclude(device *pci.Device, exclude string) bool {
+	exclude = strings.ToLower(strings.TrimSpace(exclude))
+
+	switch {
+	case exclude == "bridge" || exclude == "bridges":
+		return isBridge(device)
+	case strings.Contains(exclude, "."):
+		// PCI addresses can be given without the domain (ex: 00:1f.3)
+		return normalizeAddress(exclude) == device.Address
+	case strings.Contains(exclude, ":"):
+		return matchesID(device, exclude)
+	default:
+		return matchesClass(device, exclude)
+	}
+}
+
+// Checks if a device is a bridge, bridges have the class code 06 or a PCI-to-PCI or CardBus bridge header
+func isBridge(device *pci.Device) bool {
+	return device.Class.ID == "06" || hasBridgeHeader(device.Address)
+}
+
+// Checks if the device at a PCI address is a bridge, for when we only have the address
+func isBridgeAddress(address string) bool {
+	return strings.HasPrefix(readDeviceAttr(address, "class"), "0x06") || hasBridgeHeader(address)
+}
+
+// Checks if a device has a bridge header, some bridges do not use the bridge class code but they still have a bridge header
+func hasBridgeHeader(address string) bool {
+	switch getHeaderType(address) {
+	case headerTypeBridge, headerTypeCardBus:
+		return true
+	}
+
+	return false
+}
+
+// Checks if a device should be listed when only printing the VendorID:DeviceID or PCI Address,
+// bridges are left out unless --bridges=show or --bridges=only is given
+func showInIDOutput(device *pci.Device, pArg *params.Params) bool {
+	return !isBridge(device) || pArg.String["bridges"] == "show" || pArg.String["bridges"] == "only"
+}
+
+// Checks if a device is bound to any of the drivers given, the driver names can use the wildcards * and ?
+func matchesAnyDriver(device *pci.Device, drivers []string) bool {
+	// Devices without a driver can not match a driver name
+	if device.Driver == "" {
+		return false
+	}
+
+	for _, driver := range drivers {
+		match, err := path.Match(driver, device.Driver)
+		errorcheck.ErrorCheck(err, fmt.Sprintf("Invalid wildcard in driver %s", driver))
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if a device matches any of the ID patterns given
+func matchesAnyID(device *pci.Device, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesID(device, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if a device matches an ID pattern in the form vendor[:device[:subvendor[:subdevice]]],
+// every part of the pattern can use the wildcards * and ?
+func matchesID(device *pci.Device, pattern string) bool {
+	// The IDs of the device in the same order as the pattern
+	ids := []string{
+		device.Vendor.ID,
+		device.Product.ID,
+		device.Subsystem.VendorID,
+		device.Subsystem.ID,
+	}
+
+	parts := strings.Split(strings.ToLower(pattern), ":")
+	if len(parts) > len(ids) {
+		errorcheck.ErrorCheck(
+			fmt.Errorf("invalid ID %s", pattern),
+			"IDs must be in the form vendor[:device[:subvendor[:subdevice]]]",
+		)
+	}
+
+	// Every part given has to match the ID at the same position, omitted parts match anything
+	for i, part := range parts {
+		match, err := path.Match(part, strings.ToLower(ids[i]))
+		errorcheck.ErrorCheck(err, fmt.Sprintf("Invalid wildcard in ID %s", pattern))
+
+		if !match {
+			return false
+		}
+	}
+
+	return true
+}
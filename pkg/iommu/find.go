@@ -0,0 +1,226 @@
+package iommu
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	"github.com/jaypipes/ghw"
+)
+
+// A device found by FindDevices and how well it matched the search
+type foundDevice struct {
+	output  []string
+	address string
+	score   int
+}
+
+// A name to search in and how much a match in it is worth
+type weightedName struct {
+	name   string
+	weight int
+}
+
+// How much a match in each name is worth, matches in the product name are the most important
+const (
+	productWeight   = 3
+	subsystemWeight = 2
+	vendorWeight    = 1
+)
+
+// Finds devices by vendor, product, subsystem and OEM name and returns them with the best matches first
+func FindDevices(text string, pArg *params.Params) []string {
+	var found []foundDevice
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	// We need the vendor names from the pci.ids database to get the OEM names
+	pci, err := ghw.PCI(ghw.WithDisableWarnings())
+	errorcheck.ErrorCheck(err, "Failed to parse PCI devices")
+
+	query := searchWords(text)
+
+	// Iterate through the groups, group numbers can have gaps so we range over them
+	for _, group := range alldevs.Groups {
+		// For each device
+		for _, device := range group.Devices {
+			// Skip devices that do not pass the filters
+			if !filterDevice(group, device, pArg) {
+				continue
+			}
+
+			// Get the OEM name if the subvendor is known
+			oem := ""
+			if subvendor := pci.Vendors[device.Subsystem.VendorID]; subvendor != nil {
+				oem = subvendor.Name
+			}
+
+			// Give the device a score based on how well it matches
+			score := scoreDevice(query, []weightedName{
+				{name: device.Product.Name, weight: productWeight},
+				{name: device.Subsystem.Name, weight: subsystemWeight},
+				{name: device.Vendor.Name, weight: vendorWeight},
+				{name: oem, weight: vendorWeight},
+			})
+
+			if score > 0 {
+				found = append(found, foundDevice{
+					output:  genDeviceOutput(group, device, pArg),
+					address: device.Address,
+					score:   score,
+				})
+			}
+		}
+	}
+
+	// Sort the devices so the best matches come first, devices with the same score are sorted by address
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score > found[j].score
+		}
+		return found[i].address < found[j].address
+	})
+
+	// Make our output from the sorted devices
+	var devs []string
+	for _, dev := range found {
+		devs = append(devs, dev.output...)
+	}
+
+	return devs
+}
+
+// Scores how well the query matches a set of names and their weights, returns 0 if it does not match.
+// Every word in the query has to match a word in one of the names
+func scoreDevice(query []string, names []weightedName) int {
+	score := 0
+
+	// Names not in the pci.ids database are not worth searching
+	var known []weightedName
+	for _, name := range names {
+		if name.name != "" && name.name != "unknown" {
+			known = append(known, name)
+		}
+	}
+
+	// If the query matches a name when ignoring spaces and symbols (ex: "rtx4070" and "RTX 4070") it is a strong match
+	compactQuery := strings.Join(query, "")
+	for _, name := range known {
+		if compactQuery != "" && strings.Contains(strings.Join(searchWords(name.name), ""), compactQuery) {
+			score += 10 * name.weight
+		}
+	}
+
+	// Then score each word in the query by its best match
+	compactMatch := score > 0
+	for _, word := range query {
+		best := 0
+		for _, name := range known {
+			for _, nameWord := range searchWords(name.name) {
+				if wordScore := scoreWord(word, nameWord) * name.weight; wordScore > best {
+					best = wordScore
+				}
+			}
+		}
+
+		// If a word does not match anything and the whole query did not match, the device does not match
+		if best == 0 && !compactMatch {
+			return 0
+		}
+		score += best
+	}
+
+	return score
+}
+
+// Scores how well a word in the query matches a word in a name
+func scoreWord(word string, nameWord string) int {
+	switch {
+	case word == nameWord:
+		return 4
+	case strings.HasPrefix(nameWord, word):
+		return 3
+	case strings.Contains(nameWord, word):
+		return 2
+	case hasDigit(word):
+		// Model numbers have to match exactly, RTX 4070 is not a typo of RTX 3070
+		return 0
+	case len(word) >= 5 && editDistance(word, nameWord) <= len(word)/4:
+		// Allow a typo for every 4 characters in longer words
+		return 1
+	case len(word) >= 3 && len(word) <= 4 && editDistance(word, nameWord) <= 1:
+		// Short words get a single typo
+		return 1
+	case len(word) >= 3 && isAbbreviation(word, nameWord):
+		// Abbreviations like blk for block or ctrl for controller
+		return 1
+	}
+
+	return 0
+}
+
+// Checks if a word contains a digit
+func hasDigit(word string) bool {
+	return strings.IndexFunc(word, unicode.IsDigit) >= 0
+}
+
+// Checks if a word is an abbreviation of a name word, it has to start with the same letter
+// and every letter of it has to be in the name word in the same order
+func isAbbreviation(word string, nameWord string) bool {
+	letters, nameLetters := []rune(word), []rune(nameWord)
+	if len(letters) == 0 || len(nameLetters) == 0 || letters[0] != nameLetters[0] {
+		return false
+	}
+
+	i := 0
+	for _, r := range nameLetters {
+		if i < len(letters) && letters[i] == r {
+			i++
+		}
+	}
+
+	return i == len(letters)
+}
+
+// Splits text into lowercase words, anything that is not a letter or digit separates words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Calculates the Levenshtein distance between two words
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// We only need the previous row of the distance matrix
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			// Pick the cheapest of a deletion, an insertion or a substitution
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+
+	return prev[len(rb)]
+}
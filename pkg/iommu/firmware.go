@@ -0,0 +1,269 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+	Helpers for the ACPI tables the firmware uses to describe the IOMMU
+
+	DMAR describes Intel VT-d and IVRS describes AMD-Vi, if neither exists the
+	firmware does not have the IOMMU enabled. The IVRS table also tells the IOMMU
+	which devices use the requester ID of another device (aliases), those devices
+	end up in the same IOMMU group. The DMAR table tells which devices every
+	IOMMU unit (DRHD) translates, devices no unit translates get no IOMMU group
+*/
+
+// Where the kernel exposes the ACPI tables
+const acpiTablesDir = "/sys/firmware/acpi/tables"
+
+// Offsets in the IVRS table
+const (
+	// The IVHD blocks start after the ACPI header (36 bytes), IVinfo (4 bytes) and 8 reserved bytes
+	ivrsBlocksStart = 48
+
+	// IVHD block types and the size of their header
+	ivhdType10     = 0x10
+	ivhdType11     = 0x11
+	ivhdType40     = 0x40
+	ivhdHeader10   = 24
+	ivhdHeader1140 = 40
+
+	// IVHD device entry types we care about
+	ivhdEntryEndRange        = 0x04
+	ivhdEntryAliasSelect     = 0x42
+	ivhdEntryAliasStartRange = 0x43
+	ivhdEntryACPIHID         = 0xf0
+)
+
+// Offsets in the DMAR table
+const (
+	// The remapping structures start after the ACPI header (36 bytes), the host address width, flags and 10 reserved bytes
+	dmarStructsStart = 48
+
+	// The remapping structure type of an IOMMU unit and the size of its header
+	dmarTypeDRHD   = 0
+	dmarHeaderDRHD = 16
+
+	// Set in the flags of an IOMMU unit if it translates every device in its PCI segment the other units do not list
+	dmarIncludePCIAll = 0x01
+
+	// Device scope types we care about, the path of a scope starts at its bus (offset 5) and is 2 bytes per bridge (from offset 6)
+	dmarScopeEndpoint = 0x01
+	dmarScopeBridge   = 0x02
+	dmarScopePath     = 6
+)
+
+// The devices an IOMMU unit in the DMAR table translates
+type dmarUnit struct {
+	Segment uint16
+	// If the unit translates every device in its segment
+	IncludeAll bool
+	// The PCI addresses of the devices in the scope of the unit, everything below a bridge in the list is in scope too
+	Devices []string
+}
+
+// Returns the ACPI table the firmware describes the IOMMU with (DMAR or IVRS), returns an empty string if there is none
+func getFirmwareIOMMUTable() string {
+	for _, table := range []string{"DMAR", "IVRS"} {
+		if _, err := os.Stat(fmt.Sprintf("%s/%s", acpiTablesDir, table)); err == nil {
+			return table
+		}
+	}
+
+	return ""
+}
+
+// Gets the devices the IVRS table gives an alias, as a map of PCI address to the PCI address of the alias.
+// The alias can be a device that does not exist. Ranges are only expanded for the addresses given.
+// Returns an empty map if there is no IVRS table or it can not be read (needs root)
+func getIVRSAliases(addresses []string) map[string]string {
+	table, err := os.ReadFile(fmt.Sprintf("%s/IVRS", acpiTablesDir))
+	if err != nil {
+		return make(map[string]string)
+	}
+
+	return parseIVRSAliases(table, addresses)
+}
+
+// Parses the aliases of the devices out of an IVRS table
+func parseIVRSAliases(table []byte, addresses []string) map[string]string {
+	aliases := make(map[string]string)
+
+	// Walk the IVHD blocks, each block is [type, flags, length (16 bits), ...]
+	for offset := ivrsBlocksStart; offset+4 <= len(table); {
+		blockType := table[offset]
+		length := int(readConfig16(table, offset+2))
+		if length == 0 || offset+length > len(table) {
+			break
+		}
+
+		switch blockType {
+		case ivhdType10:
+			parseIVHDAliases(table[offset:offset+length], ivhdHeader10, addresses, aliases)
+		case ivhdType11, ivhdType40:
+			parseIVHDAliases(table[offset:offset+length], ivhdHeader1140, addresses, aliases)
+		}
+		offset += length
+	}
+
+	return aliases
+}
+
+// Parses the alias entries of an IVHD block into the aliases map
+func parseIVHDAliases(block []byte, headerSize int, addresses []string, aliases map[string]string) {
+	// The PCI segment of the devices is in the block header, after the MMIO base address of the IOMMU
+	segment := readConfig16(block, 16)
+
+	rangeStart, rangeAlias := -1, -1
+	for offset := headerSize; offset < len(block); {
+		entryType := block[offset]
+		id := int(readConfig16(block, offset+1))
+
+		// The size of an entry depends on its type
+		size := 4
+		switch {
+		case entryType == ivhdEntryACPIHID:
+			if offset+21 >= len(block) {
+				return
+			}
+			size = 22 + int(block[offset+21])
+		case entryType >= 0x80:
+			// We do not know how long other variable length entries are
+			return
+		case entryType >= 0x40:
+			size = 8
+		}
+		if offset+size > len(block) {
+			return
+		}
+
+		switch entryType {
+		case ivhdEntryAliasSelect:
+			aliases[ivrsAddress(segment, id)] = ivrsAddress(segment, int(readConfig16(block, offset+5)))
+		case ivhdEntryAliasStartRange:
+			rangeStart, rangeAlias = id, int(readConfig16(block, offset+5))
+		case ivhdEntryEndRange:
+			// Give every device in the range the alias
+			if rangeStart >= 0 && rangeAlias >= 0 {
+				for _, address := range addresses {
+					var domain, bus, slot, function int
+					if _, err := fmt.Sscanf(address, "%04x:%02x:%02x.%x", &domain, &bus, &slot, &function); err != nil {
+						continue
+					}
+					deviceID := bus<<8 | slot<<3 | function
+					if domain == int(segment) && deviceID >= rangeStart && deviceID <= id {
+						aliases[address] = ivrsAddress(segment, rangeAlias)
+					}
+				}
+			}
+			rangeStart, rangeAlias = -1, -1
+		}
+
+		offset += size
+	}
+}
+
+// Turns a PCI segment and a requester ID from the IVRS table into a PCI address
+func ivrsAddress(segment uint16, id int) string {
+	return fmt.Sprintf("%04x:%02x:%02x.%x", segment, id>>8, (id>>3)&0x1f, id&0x7)
+}
+
+// Gets the IOMMU units from the DMAR table.
+// Returns nil if there is no DMAR table or it can not be read (needs root)
+func getDMARUnits() []*dmarUnit {
+	table, err := os.ReadFile(fmt.Sprintf("%s/DMAR", acpiTablesDir))
+	if err != nil {
+		return nil
+	}
+
+	return parseDMARUnits(table, getSecondaryBus)
+}
+
+// Parses the IOMMU units out of a DMAR table, the bus behind a bridge is looked up with secondaryBus to walk the scope paths
+func parseDMARUnits(table []byte, secondaryBus func(address string) int) []*dmarUnit {
+	units := []*dmarUnit{}
+
+	// Walk the remapping structures, each structure is [type (16 bits), length (16 bits), ...]
+	for offset := dmarStructsStart; offset+4 <= len(table); {
+		structType := readConfig16(table, offset)
+		length := int(readConfig16(table, offset+2))
+		if length == 0 || offset+length > len(table) {
+			break
+		}
+
+		if structType == dmarTypeDRHD && length >= dmarHeaderDRHD {
+			drhd := table[offset : offset+length]
+			unit := &dmarUnit{
+				Segment:    readConfig16(drhd, 6),
+				IncludeAll: drhd[4]&dmarIncludePCIAll != 0,
+			}
+
+			// Every device scope is [type, length, reserved (16 bits), enumeration ID, bus, path]
+			for scope := dmarHeaderDRHD; scope+dmarScopePath <= len(drhd); {
+				scopeType := drhd[scope]
+				scopeLength := int(drhd[scope+1])
+				if scopeLength < dmarScopePath || scope+scopeLength > len(drhd) {
+					break
+				}
+
+				if scopeType == dmarScopeEndpoint || scopeType == dmarScopeBridge {
+					path := drhd[scope+dmarScopePath : scope+scopeLength]
+					if address := walkDMARPath(unit.Segment, int(drhd[scope+5]), path, secondaryBus); address != "" {
+						unit.Devices = append(unit.Devices, address)
+					}
+				}
+				scope += scopeLength
+			}
+
+			units = append(units, unit)
+		}
+		offset += length
+	}
+
+	return units
+}
+
+// Walks the path of a device scope from its bus through the bridges, every step is [device, function].
+// Returns the PCI address at the end of the path or an empty string if a bridge on the way does not exist
+func walkDMARPath(segment uint16, bus int, path []byte, secondaryBus func(address string) int) string {
+	address := ""
+	for step := 0; step+1 < len(path); step += 2 {
+		if address != "" {
+			if bus = secondaryBus(address); bus < 0 {
+				return ""
+			}
+		}
+		address = fmt.Sprintf("%04x:%02x:%02x.%x", segment, bus, path[step], path[step+1])
+	}
+
+	return address
+}
+
+// Checks if an IOMMU unit from the DMAR table translates a device, every device is translated if there is no DMAR table
+func isTranslated(units []*dmarUnit, address string) bool {
+	if units == nil {
+		return true
+	}
+
+	var domain uint16
+	if _, err := fmt.Sscanf(address, "%04x:", &domain); err != nil {
+		return false
+	}
+	for _, unit := range units {
+		if unit.Segment != domain {
+			continue
+		}
+		if unit.IncludeAll {
+			return true
+		}
+		for _, device := range unit.Devices {
+			if device == address || isBelow(address, device) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+package iommu
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Builds an IVHD block with the given header size, MMIO base address, PCI segment and device entries
+func testIVHDBlock(blockType byte, headerSize int, mmioBase uint64, segment uint16, entries ...[]byte) []byte {
+	block := make([]byte, headerSize)
+	block[0] = blockType
+	binary.LittleEndian.PutUint64(block[8:], mmioBase)
+	binary.LittleEndian.PutUint16(block[16:], segment)
+	for _, entry := range entries {
+		block = append(block, entry...)
+	}
+	binary.LittleEndian.PutUint16(block[2:], uint16(len(block)))
+
+	return block
+}
+
+// Builds a 4 byte IVHD device entry
+func testIVHDEntry4(entryType byte, id uint16) []byte {
+	return []byte{entryType, byte(id), byte(id >> 8), 0}
+}
+
+// Builds an 8 byte IVHD device entry with an alias
+func testIVHDEntry8(entryType byte, id uint16, alias uint16) []byte {
+	return []byte{entryType, byte(id), byte(id >> 8), 0, 0, byte(alias), byte(alias >> 8), 0}
+}
+
+func TestParseIVRSAliases(t *testing.T) {
+	table := make([]byte, ivrsBlocksStart)
+	copy(table, "IVRS")
+
+	// The low bits of the MMIO base address are not 0, so reading the segment from there gives 0x4000
+	table = append(table, testIVHDBlock(ivhdType10, ivhdHeader10, 0xfeb84000, 0,
+		// 00:01.0 without an alias
+		testIVHDEntry4(0x02, 0x0008),
+		// 03:00.0 uses the requester ID of 02:00.0
+		testIVHDEntry8(ivhdEntryAliasSelect, 0x0300, 0x0200),
+		// Everything on bus 04 uses the requester ID of 0a:00.0
+		testIVHDEntry8(ivhdEntryAliasStartRange, 0x0400, 0x0a00),
+		testIVHDEntry4(ivhdEntryEndRange, 0x04ff),
+	)...)
+	table = append(table, testIVHDBlock(ivhdType11, ivhdHeader1140, 0xfd208000, 1,
+		// 0001:01:00.0 uses the requester ID of 0001:00:01.0
+		testIVHDEntry8(ivhdEntryAliasSelect, 0x0100, 0x0008),
+	)...)
+
+	addresses := []string{"0000:04:00.0", "0000:04:1f.7", "0000:05:00.0", "0001:04:00.0"}
+	want := map[string]string{
+		"0000:03:00.0": "0000:02:00.0",
+		"0000:04:00.0": "0000:0a:00.0",
+		"0000:04:1f.7": "0000:0a:00.0",
+		"0001:01:00.0": "0001:00:01.0",
+	}
+
+	if got := parseIVRSAliases(table, addresses); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIVRSAliases() = %v, want %v", got, want)
+	}
+}
+
+func TestParseIVRSAliasesTruncated(t *testing.T) {
+	table := make([]byte, ivrsBlocksStart)
+	table = append(table, testIVHDBlock(ivhdType10, ivhdHeader10, 0, 0,
+		testIVHDEntry8(ivhdEntryAliasSelect, 0x0300, 0x0200),
+	)...)
+
+	// A block that is longer than the table is not parsed
+	if got := parseIVRSAliases(table[:len(table)-1], nil); len(got) != 0 {
+		t.Errorf("parseIVRSAliases() on a truncated table = %v, want no aliases", got)
+	}
+}
+
+// Builds a DRHD structure with the given flags, PCI segment and device scopes
+func testDRHD(flags byte, segment uint16, scopes ...[]byte) []byte {
+	drhd := make([]byte, dmarHeaderDRHD)
+	binary.LittleEndian.PutUint16(drhd, dmarTypeDRHD)
+	drhd[4] = flags
+	binary.LittleEndian.PutUint16(drhd[6:], segment)
+	binary.LittleEndian.PutUint64(drhd[8:], 0xfed90000)
+	for _, scope := range scopes {
+		drhd = append(drhd, scope...)
+	}
+	binary.LittleEndian.PutUint16(drhd[2:], uint16(len(drhd)))
+
+	return drhd
+}
+
+// Builds a device scope, the path is [device, function] for every step
+func testDMARScope(scopeType byte, bus byte, path ...byte) []byte {
+	scope := []byte{scopeType, byte(dmarScopePath + len(path)), 0, 0, 0, bus}
+
+	return append(scope, path...)
+}
+
+func TestParseDMARUnits(t *testing.T) {
+	table := make([]byte, dmarStructsStart)
+	copy(table, "DMAR")
+
+	table = append(table, testDRHD(0, 0,
+		// The integrated GPU
+		testDMARScope(dmarScopeEndpoint, 0x00, 0x02, 0x0),
+		// The device behind the root port 00:1c.0
+		testDMARScope(dmarScopeEndpoint, 0x00, 0x1c, 0x0, 0x00, 0x0),
+		// A bridge that does not exist
+		testDMARScope(dmarScopeBridge, 0x00, 0x1d, 0x0, 0x00, 0x0),
+	)...)
+	// A reserved memory region (RMRR) is skipped
+	rmrr := make([]byte, 24)
+	binary.LittleEndian.PutUint16(rmrr, 1)
+	binary.LittleEndian.PutUint16(rmrr[2:], uint16(len(rmrr)))
+	table = append(table, rmrr...)
+	table = append(table, testDRHD(dmarIncludePCIAll, 0,
+		// The IOAPIC is not a PCI device
+		testDMARScope(0x03, 0xf0, 0x1f, 0x0),
+	)...)
+
+	secondaryBus := func(address string) int {
+		if address == "0000:00:1c.0" {
+			return 3
+		}
+		return -1
+	}
+
+	want := []*dmarUnit{
+		{Segment: 0, Devices: []string{"0000:00:02.0", "0000:03:00.0"}},
+		{Segment: 0, IncludeAll: true},
+	}
+	if got := parseDMARUnits(table, secondaryBus); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDMARUnits() = %+v, want %+v", got, want)
+	}
+}
+
+func TestIsTranslated(t *testing.T) {
+	units := []*dmarUnit{
+		{Segment: 0, Devices: []string{"0000:00:02.0"}},
+		{Segment: 1, IncludeAll: true},
+	}
+
+	tests := []struct {
+		units   []*dmarUnit
+		address string
+		want    bool
+	}{
+		// Without a DMAR table we can not tell, so every device is translated
+		{nil, "0000:00:14.0", true},
+		{units, "0000:00:02.0", true},
+		{units, "0001:05:00.0", true},
+		{units, "0000:00:14.0", false},
+		{units, "0002:00:02.0", false},
+	}
+
+	for _, test := range tests {
+		if got := isTranslated(test.units, test.address); got != test.want {
+			t.Errorf("isTranslated(%q) = %v, want %v", test.address, got, test.want)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package iommu
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
 
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
 	"github.com/HikariKnight/ls-iommu/pkg/params"
 	"github.com/jaypipes/ghw"
 	"github.com/jaypipes/ghw/pkg/pci"
@@ -46,7 +48,7 @@ func GenDeviceLine(group int, device *pci.Device, pArg *params.Params) string {
 
 	formating := strings.Split(pArg.String["format"], ",")
 
-	formated_line = append(formated_line, fmt.Sprintf("IOMMU Group %s:", iommu_group))
+	formated_line = append(formated_line, fmt.Sprintf("%s %s:", groupLabel(), iommu_group))
 	for _, object := range formating {
 		// Apply the object into our formated line in the order specified with -F
 		switch object {
@@ -98,6 +100,22 @@ func GenDeviceLine(group int, device *pci.Device, pArg *params.Params) string {
 			} else {
 				formated_line = append(formated_line, ":")
 			}
+		case "viable":
+			formated_line = append(formated_line, viabilityColumn(group))
+		case "viable:":
+			formated_line = append(formated_line, fmt.Sprintf("%s:", viabilityColumn(group)))
+		case "boot_vga":
+			// Only mark the GPU the firmware initialised, passing it through needs extra steps.
+			// The legacy output stays the same as the bash script
+			if !pArg.Flag["legacyoutput"] && isBootVGA(device.Address) {
+				formated_line = append(formated_line, "[boot VGA]")
+			}
+		case "boot_vga:":
+			if !pArg.Flag["legacyoutput"] && isBootVGA(device.Address) {
+				formated_line = append(formated_line, "[boot VGA]:")
+			} else {
+				formated_line = append(formated_line, ":")
+			}
 		}
 	}
 
@@ -162,6 +180,15 @@ func GenKernelInfo(group int, device *pci.Device) string {
 		)
 	}
 
+	// Add what the host uses the GPU for if it is the boot VGA device
+	line = fmt.Sprintf("%s%s", line, genBootVGAInfo(device.Address))
+
+	// Add the known problems of the device
+	line = fmt.Sprintf("%s%s", line, genQuirkInfo(device))
+
+	// Add how the device can be reset
+	line = fmt.Sprintf("%s%s", line, genResetInfo(device.Address))
+
 	return line
 }
 
@@ -185,17 +212,91 @@ func generateDevList(id int, device *pci.Device, pArg *params.Params) string {
 	return line
 }
 
+// Generates the output for a device depending on the output modifiers given (--rom, --id, --pciaddr, --json),
+// without any of them we generate the full device line
+func genDeviceOutput(group *Group, device *pci.Device, pArg *params.Params) []string {
+	id := group.ID
+	warnBootVGA(device, pArg)
+
+	switch {
+	case pArg.Flag["json"]:
+		return []string{genJSONRecord(group, device, nil)}
+
+	case pArg.Flag["rom"]:
+		// Get the rom path of the device if it has one
+		return GetRomPath(device, pArg)
+
+	case pArg.Flag["id"] || pArg.Flag["pciaddr"]:
+		// Bridges are left out of the ID and PCI Address output
+		if !showInIDOutput(device, pArg) {
+			return nil
+		}
+
+		if pArg.Flag["id"] {
+			// If --id is supplied as an argument we display the VendorID:DeviceID,
+			// the PCI address is carried along after a tab for PrintLines to check for shared IDs
+			return []string{fmt.Sprintf("%s:%s\t%s\n", device.Vendor.ID, device.Product.ID, device.Address)}
+		}
+
+		// If --pciaddr is supplied as an argument we display the PCI Address
+		return []string{fmt.Sprintf("%s\n", device.Address)}
+	}
+
+	// Generate the device list with the data we want
+	return []string{generateDevList(id, device, pArg)}
+}
+
+// Generates the record of a device as a single line of JSON, related are the labels of a related device
+func genJSONRecord(group *Group, device *pci.Device, related []string) string {
+	record := NewRecord(group, device)
+	record.Reset = getResetInfo(device.Address)
+	record.Related = related
+	line, err := json.Marshal(record)
+	errorcheck.ErrorCheck(err, "Failed to generate JSON")
+
+	return fmt.Sprintf("%s\n", line)
+}
+
 // Function to just print out a string array to STDOUT
 func PrintOutput(out []string, pArg *params.Params) {
-	// Remove duplicate lines
-	output := removeDuplicateLines(out)
+	// Merge the labels of related devices and remove duplicate lines
+	output := removeDuplicateLines(mergeRelatedLabels(out))
 	// Sort cleaned output
 	sort.Strings(output)
 
+	PrintLines(output, pArg)
+}
+
+// Prints the output in the order it is in, the JSON records are printed as an array if --json is given
+func PrintLines(output []string, pArg *params.Params) {
+	if pArg.Flag["json"] {
+		var records []string
+		for _, line := range output {
+			records = append(records, strings.TrimSuffix(line, "\n"))
+		}
+		if len(records) == 0 {
+			fmt.Println("[]")
+		} else {
+			fmt.Printf("[\n%s\n]\n", strings.Join(records, ",\n"))
+		}
+		return
+	}
+
+	// The --id lines carry the PCI address of the device, only the IDs are printed
+	var selected []string
+	if pArg.Flag["id"] {
+		output, selected = splitIDLines(output)
+	}
+
 	// Print output line by line
 	for _, line := range output {
 		fmt.Print(line)
 	}
+
+	// The IDs are meant for vfio-pci.ids, warn if that would bind devices that were not selected
+	if pArg.Flag["id"] {
+		warnSharedIDs(selected)
+	}
 }
 
 // Removes duplicate lines from a string slice, useful for cleaning up the output if doing multiple scans
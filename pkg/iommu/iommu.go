@@ -2,7 +2,6 @@ package iommu
 
 import (
 	"fmt"
-	"log"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -16,8 +15,16 @@ import (
 
 type IOMMU struct {
 	Groups map[int]*Group
+	// If the IOMMU is disabled and the groups are predicted
+	Predicted bool
 }
 
+// Set once the groups have been predicted, so the output can be marked as a prediction
+var predictedGroups = false
+
+// Set once the user has been told the groups are predicted
+var warnedPrediction = false
+
 // Adds a Group struct to the IOMMU struct
 func (i *IOMMU) AddGroup(group *Group) {
 	i.Groups[group.ID] = group
@@ -41,6 +48,17 @@ func NewGroup(id int, devices map[string]*ghwpci.Device) *Group {
 	}
 }
 
+// Finds a device by its PCI address and returns it along with the group it is in, returns nil if it does not exist
+func (i *IOMMU) FindDevice(address string) (*Group, *ghwpci.Device) {
+	for _, group := range i.Groups {
+		if device, exists := group.Devices[address]; exists {
+			return group, device
+		}
+	}
+
+	return nil, nil
+}
+
 func (i *IOMMU) Read() {
 	i.Groups = make(map[int]*Group)
 	// Get all groups and associated devices
@@ -95,8 +113,9 @@ func (i *IOMMU) Read() {
 	}
 
 	// If we have 0 groups so far, IOMMU is probably disabled
+	// so predict the groups we would get if it was enabled
 	if len(i.Groups) == 0 {
-		log.Fatal("IOMMU Disabled in UEFI/BIOS and/or not enabled in boot arguments!")
+		i.predict(pci.Devices)
 	}
 }
 
@@ -119,13 +138,17 @@ func GetAllDevices(pArg *params.Params) []string {
 	// Prepare a string slice for storing our output
 	var lspci_devs []string
 
-	// Iterate through the IOMMU groups and get the device info
-	for id := 0; id < len(iommu.Groups); id++ {
+	// Iterate through the IOMMU groups and get the device info, group numbers can have gaps so we range over them
+	for _, group := range iommu.Groups {
 		// Iterate each device
-		for _, device := range iommu.Groups[id].Devices {
-			// Generate the device list with the data we want
-			line := generateDevList(id, device, pArg)
-			lspci_devs = append(lspci_devs, line)
+		for _, device := range group.Devices {
+			// Skip devices that do not pass the filters
+			if !filterDevice(group, device, pArg) {
+				continue
+			}
+
+			// Generate the output for the device with the data we want
+			lspci_devs = append(lspci_devs, genDeviceOutput(group, device, pArg)...)
 		}
 	}
 
@@ -133,85 +156,38 @@ func GetAllDevices(pArg *params.Params) []string {
 }
 
 func MatchSubclass(searchval string, pArg *params.Params) []string {
+	// Match every device that has a subclass containing our search value
+	return matchDevices(func(device *ghwpci.Device) bool {
+		return strings.Contains(device.Subclass.Name, searchval)
+	}, pArg)
+}
+
+// Gets all devices the match function returns true for, used by the device selectors
+func matchDevices(match func(device *ghwpci.Device) bool, pArg *params.Params) []string {
 	var devs []string
 
 	// Get all IOMMU devices
 	alldevs := NewIOMMU()
 
-	// Make a regex to find devices that will need special exceptions for relative search
-	//specialRelativeExceptions := regexp.MustCompile(`^(SATA|USB) controller`)
+	// Iterate through the groups, group numbers can have gaps so we range over them
+	for id, group := range alldevs.Groups {
+		// Skip the groups that were not asked for with -i
+		if !isSelectedGroup(id, pArg) {
+			continue
+		}
 
-	// Iterate through the groups
-	for id := 0; id < len(alldevs.Groups); id++ {
 		// For each device
-		for _, device := range alldevs.Groups[id].Devices {
-			// If the device has a subclass matching what we are looking for
-			if strings.Contains(device.Subclass.Name, searchval) {
-				if len(pArg.IntList["iommu_group"]) == 0 && !pArg.Flag["rom"] {
-					// Generate the device list with the data we want
-					line := generateDevList(id, device, pArg)
-					devs = append(devs, line)
-
-					// If we want to search for related devices
-					if pArg.FlagCounter["related"] == 1 {
-						// Prevent an infinite loop by passing 0 instead of related
-						other := GetDevicesFromGroups([]int{id}, 0, pArg)
-						devs = append(devs, other...)
-
-					} else if pArg.FlagCounter["related"] == 2 {
-						// Find relatives and add them to the list
-						related_list := findRelatedDevices(device.Vendor.ID, pArg.FlagCounter["related"], pArg)
-						devs = append(devs, related_list...)
-					}
-
-				} else if pArg.Flag["rom"] && pArg.Flag["gpu"] {
-					// If we are asked to get the path to the gpu vbios
-					if len(pArg.IntList["iommu_group"]) > 0 {
-						// If we are asked to only get a specific IOMMU group
-						for _, group := range pArg.IntList["iommu_group"] {
-							// If the iommu group matches the one we are currently processing
-							if id == group {
-								// Print the GPU rom path
-								devs = append(devs, GetRomPath(device, pArg)...)
-							}
-						}
-
-					} else {
-						// Else get the vbios path for any gpu
-						devs = append(devs, GetRomPath(device, pArg)...)
-					}
-
-				} else {
-					for _, group := range pArg.IntList["iommu_group"] {
-						if id == group {
-							// If we want the Device ID or PCI Address
-							if pArg.Flag["id"] && !pArg.Flag["pciaddr"] {
-								// If --id is supplied as an argument we display the VendorID:DeviceID
-								devs = append(devs, fmt.Sprintf("%s:%s\n", device.Vendor.ID, device.Product.ID))
-
-							} else if !pArg.Flag["id"] && pArg.Flag["pciaddr"] {
-								// If --pciaddr is supplied as an argument we display the PCI Address
-								devs = append(devs, fmt.Sprintf("%s\n", device.Address))
-
-							} else {
-								// Generate the device list with the data we want
-								line := generateDevList(id, device, pArg)
-								devs = append(devs, line)
-							}
-
-							// If we want to search for related devices
-							if pArg.FlagCounter["related"] == 1 {
-								// Prevent an infinite loop by passing 0 instead of related
-								other := GetDevicesFromGroups([]int{id}, 0, pArg)
-								devs = append(devs, other...)
-
-							} else if pArg.FlagCounter["related"] == 2 {
-								// Find relatives and add them to the list
-								related_list := findRelatedDevices(device.Vendor.ID, pArg.FlagCounter["related"], pArg)
-								devs = append(devs, related_list...)
-							}
-						}
-					}
+		for _, device := range group.Devices {
+			// If the device matches what we are looking for and passes the filters
+			if match(device) && filterDevice(group, device, pArg) {
+				// Generate the output for the device with the data we want
+				devs = append(devs, genDeviceOutput(group, device, pArg)...)
+
+				// If we want to search for related devices
+				if pArg.FlagCounter["related"] > 0 {
+					// Find relatives and add them to the list
+					related_list := findRelatedDevices(device, pArg.FlagCounter["related"], pArg)
+					devs = append(devs, related_list...)
 				}
 			}
 		}
@@ -239,107 +215,29 @@ func GetDevicesFromGroups(groups []int, related int, pArg *params.Params) []stri
 			} else {
 				// For each device in specified IOMMU group
 				for _, device := range alldevs.Groups[group].Devices {
-					// If we do not want the Device IDs or PCI Address
-					if !pArg.Flag["id"] && !pArg.Flag["pciaddr"] {
-						// Generate the device list with the data we want
-						line := generateDevList(group, device, pArg)
-
-						// Append line to output
-						output = append(output, line)
-
-						if related > 0 {
-							// Find relatives and add them to the list
-							related_list := findRelatedDevices(device.Vendor.ID, pArg.FlagCounter["related"], pArg)
-							output = append(output, related_list...)
-						}
-
-					} else if !strings.Contains(device.Subclass.Name, "bridge") {
-						if pArg.Flag["id"] && !pArg.Flag["pciaddr"] {
-							// If --id is supplied as an argument we display the VendorID:DeviceID
-							output = append(output, fmt.Sprintf("%s:%s\n", device.Vendor.ID, device.Product.ID))
-
-							if related > 0 {
-								// Find relatives and add them to the list
-								related_list := findRelatedDevices(device.Vendor.ID, pArg.FlagCounter["related"], pArg)
-								output = append(output, related_list...)
-							}
-
-						} else if !pArg.Flag["id"] && pArg.Flag["pciaddr"] {
-							// If --pciaddr is supplied as an argument we display the PCI Address
-							output = append(output, fmt.Sprintf("%s\n", device.Address))
-
-							if related > 0 {
-								// Find relatives and add them to the list
-								related_list := findRelatedDevices(device.Vendor.ID, pArg.FlagCounter["related"], pArg)
-								output = append(output, related_list...)
-							}
-						}
+					// Skip devices that do not pass the filters
+					if !filterDevice(alldevs.Groups[group], device, pArg) {
+						continue
 					}
-				}
-			}
-		}
-	}
-	return output
-}
-
-// Find related devices based on VendorID, and do a deeper search in the same IOMMU group if specified
-func findRelatedDevices(vendorid string, related int, pArg *params.Params) []string {
-	// Make a string slice for our output
-	var devs []string
-
-	// Get all IOMMU devices
-	alldevs := NewIOMMU()
 
-	// Iterate through the groups
-	for id := 0; id < len(alldevs.Groups); id++ {
-		// For each device
-		for _, device := range alldevs.Groups[id].Devices {
-			// If the device has a vendor ID matching what we are looking for
-			if strings.Contains(device.Vendor.ID, vendorid) {
-				// Make a variable to decide if device should be ignored
-				ignoreDevice := false
-
-				// Check if we should ignore the device
-				for _, ignore := range pArg.StringList["ignore"] {
-					// If the VendorID is to be ignored
-					if ignore == device.Vendor.ID {
-						// Mark device to be ignored
-						ignoreDevice = true
-					}
-				}
+					// Generate the output for the device with the data we want
+					output = append(output, genDeviceOutput(alldevs.Groups[group], device, pArg)...)
 
-				if !ignoreDevice {
-					// If we do not want the Device IDs or PCI Address
-					if !pArg.Flag["id"] && !pArg.Flag["pciaddr"] {
-						// Generate the device list with the data we want
-						line := generateDevList(id, device, pArg)
-						devs = append(devs, line)
-
-						if related > 1 {
-							// Prevent an infinite loop by passing 0 instead of related variable
-							other := GetDevicesFromGroups([]int{id}, 0, pArg)
-							devs = append(devs, other...)
-						}
-
-					} else if !strings.Contains(device.Subclass.Name, "bridge") {
-						if pArg.Flag["id"] && !pArg.Flag["pciaddr"] {
-							// If --id is supplied as an argument we display the VendorID:DeviceID
-							devs = append(devs, fmt.Sprintf("%s:%s\n", device.Vendor.ID, device.Product.ID))
-						} else if !pArg.Flag["id"] && pArg.Flag["pciaddr"] {
-							// If --pciaddr is supplied as an argument we display the PCI Address
-							devs = append(devs, fmt.Sprintf("%s\n", device.Address))
-						}
+					if related > 0 {
+						// Find relatives and add them to the list
+						related_list := findRelatedDevices(device, related, pArg)
+						output = append(output, related_list...)
 					}
 				}
 			}
 		}
 	}
-
-	return devs
+	return output
 }
 
 // Old deprecated functions marked for removal/rework below this comment
 
+// Deprecated: matches on the rendered line which changes with -F, use the --where filter instead
 func MatchDEVs(regex string, pArg *params.Params) []string {
 	var devs []string
 
@@ -0,0 +1,123 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+)
+
+// The sysfs directories we look in when given a name instead of a path (ex: eth0, nvme1n1, card1, 1-2)
+var namedDeviceDirs = []string{
+	"/sys/class/net",
+	"/sys/class/block",
+	"/sys/class/drm",
+	"/sys/class/sound",
+	"/sys/class/hidraw",
+	"/sys/class/input",
+	"/sys/bus/usb/devices",
+}
+
+// Gets the IOMMU group entries for the PCI devices behind device nodes, interface names or sysfs paths given with --of
+func GetDevicesOf(targets []string, pArg *params.Params) []string {
+	var devs []string
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	for _, target := range targets {
+		// Find the PCI device the target belongs to
+		address, err := resolvePCIAddress(target)
+		errorcheck.ErrorCheck(err)
+
+		group, device := alldevs.FindDevice(address)
+		if device == nil {
+			errorcheck.ErrorCheck(fmt.Errorf("%s belongs to PCI device %s which is not in any IOMMU group", target, address))
+		}
+
+		// Generate the device list with the data we want if the device passes the filters
+		if filterDevice(group, device, pArg) {
+			devs = append(devs, genDeviceOutput(group, device, pArg)...)
+		}
+	}
+
+	return devs
+}
+
+// Resolves a device node (ex: /dev/nvme1n1), interface or device name (ex: eth0, card2, 1-2)
+// or sysfs path to the PCI address of the device it belongs to
+func resolvePCIAddress(target string) (string, error) {
+	path, err := resolveSysfsPath(target)
+	if err != nil {
+		return "", err
+	}
+
+	// The PCI device closest to the target in the sysfs path is the one it belongs to
+	parts := strings.Split(path, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if pciAddressRegex.MatchString(parts[i]) {
+			return parts[i], nil
+		}
+	}
+
+	return "", fmt.Errorf("%s is not behind a PCI device (%s)", target, path)
+}
+
+// Resolves a device node, name or sysfs path to the real sysfs path of the device
+func resolveSysfsPath(target string) (string, error) {
+	// ALSA cards can be given by number only (ex: 2 for card2)
+	if _, err := fmt.Sscanf(target, "%d", new(int)); err == nil && !strings.ContainsAny(target, "/-:.") {
+		target = fmt.Sprintf("card%s", target)
+	}
+
+	// If the target is a path that exists
+	if info, err := os.Stat(target); err == nil {
+		// Device nodes are found in /sys/dev by their major and minor number
+		if info.Mode()&os.ModeDevice != 0 {
+			kind := "block"
+			if info.Mode()&os.ModeCharDevice != 0 {
+				kind = "char"
+			}
+
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return "", fmt.Errorf("unable to get the device number of %s", target)
+			}
+
+			major, minor := splitDeviceNumber(uint64(stat.Rdev))
+			return filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/%s/%d:%d", kind, major, minor))
+		}
+
+		// Anything else has to be a path in sysfs
+		path, err := filepath.EvalSymlinks(target)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(path, "/sys/") {
+			return "", fmt.Errorf("%s is not a device node or sysfs path", target)
+		}
+		return path, nil
+	}
+
+	// Else look for a device with that name in sysfs
+	name := filepath.Base(target)
+	for _, dir := range namedDeviceDirs {
+		if path, err := filepath.EvalSymlinks(filepath.Join(dir, name)); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to find a device node, interface or device named %s", target)
+}
+
+// Splits a Linux device number into its major and minor number
+func splitDeviceNumber(dev uint64) (uint64, uint64) {
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+
+	return major, minor
+}
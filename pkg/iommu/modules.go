@@ -0,0 +1,60 @@
+package iommu
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Gets the kernel modules that can drive a device by matching its modalias against the module aliases
+// of the running kernel, the same way lspci -k finds the kernel modules
+func getKernelModules(address string) []string {
+	var modules []string
+
+	// Get the modalias of the device (ex: pci:v000010DEd00002484sv...)
+	modalias := readDeviceAttr(address, "modalias")
+	if modalias == "" {
+		return modules
+	}
+
+	// Get the module aliases for the running kernel, builtin modules have their own file
+	release := strings.TrimSpace(readFile("/proc/sys/kernel/osrelease"))
+	found := make(map[string]bool)
+	for _, aliasFile := range []string{"modules.alias", "modules.builtin.alias"} {
+		file, err := os.Open(fmt.Sprintf("/lib/modules/%s/%s", release, aliasFile))
+		if err != nil {
+			continue
+		}
+
+		// Each line is in the form "alias <pattern> <module>"
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 || fields[0] != "alias" || !strings.HasPrefix(fields[1], "pci:") {
+				continue
+			}
+
+			if match, _ := path.Match(fields[1], modalias); match {
+				found[fields[2]] = true
+			}
+		}
+		file.Close()
+	}
+
+	for module := range found {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+
+	return modules
+}
+
+// Checks if a kernel module is loaded (or built into the kernel), module names use _ in sysfs (ex: vendor_reset)
+func isModuleLoaded(module string) bool {
+	_, err := os.Stat(fmt.Sprintf("/sys/module/%s", strings.ReplaceAll(module, "-", "_")))
+
+	return err == nil
+}
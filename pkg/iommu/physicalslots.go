@@ -0,0 +1,317 @@
+package iommu
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// Where the kernel lists the physical slots the firmware describes
+const pciSlotsDir = "/sys/bus/pci/slots"
+
+// Offset of the secondary bus number in the config space of a bridge
+const configSecondaryBus = 0x19
+
+// A physical slot or root port and the devices behind it
+type PhysicalSlot struct {
+	// The name of the physical slot, empty for root ports
+	Name string
+	// The bus and device of the slot (ex: 0000:01:00)
+	Address string
+	// The PCI address of the port the slot hangs off, empty if it is on the root bus
+	Port string
+	// CPU, chipset or unknown
+	Lanes   string
+	Devices []*ghwpci.Device
+	// The devices from outside the slot that share an IOMMU group with it
+	SharesWith []*ghwpci.Device
+	// If a card in the slot gets its own IOMMU group, only known if Known is set
+	Isolated bool
+	Known    bool
+	// Why the slot is not isolated
+	Reason string
+}
+
+// Gets the bus below a bridge, returns -1 if the device is not a bridge or it can not be read
+func getSecondaryBus(address string) int {
+	config := readConfig(address)
+	if !hasBridgeHeader(address) || len(config) <= configSecondaryBus {
+		return -1
+	}
+
+	return int(config[configSecondaryBus])
+}
+
+// Gets the physical slots and the root ports with the devices behind them, sorted by address
+func GetPhysicalSlots() ([]*PhysicalSlot, []*PhysicalSlot) {
+	var slots []*PhysicalSlot
+	var rootPorts []*PhysicalSlot
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+	var devices []*ghwpci.Device
+	for _, group := range alldevs.Groups {
+		devices = append(devices, mapDevices(group.Devices)...)
+	}
+	sortDevices(devices)
+
+	// Map the bus below every bridge to the bridge, so we can find the port a slot hangs off
+	ports := make(map[string]string)
+	for _, device := range devices {
+		if bus := getSecondaryBus(device.Address); bus >= 0 {
+			ports[fmt.Sprintf("%s:%02x", device.Address[:4], bus)] = device.Address
+		}
+	}
+
+	// The physical slots the firmware describes
+	addresses, _ := filepath.Glob(fmt.Sprintf("%s/*/address", pciSlotsDir))
+	for _, file := range addresses {
+		address := strings.TrimSpace(readFile(file))
+		if address == "" {
+			continue
+		}
+
+		slot := &PhysicalSlot{
+			Name:    filepath.Base(filepath.Dir(file)),
+			Address: address,
+		}
+		if i := strings.LastIndex(address, ":"); i > 0 {
+			slot.Port = ports[address[:i]]
+		}
+
+		// Devices in the slot are the ones below its port, or on its address if it is on the root bus
+		for _, device := range devices {
+			if (slot.Port != "" && isBelow(device.Address, slot.Port)) || slotAddress(device.Address) == address {
+				slot.Devices = append(slot.Devices, device)
+			}
+		}
+		slots = append(slots, slot)
+	}
+
+	// The root ports are the bridges on the root bus
+	for _, device := range devices {
+		if hasBridgeHeader(device.Address) && len(getParentBridges(device.Address)) == 0 {
+			port := &PhysicalSlot{
+				Address: slotAddress(device.Address),
+				Port:    device.Address,
+			}
+			for _, other := range devices {
+				if isBelow(other.Address, device.Address) {
+					port.Devices = append(port.Devices, other)
+				}
+			}
+			rootPorts = append(rootPorts, port)
+		}
+	}
+
+	// Find out where the lanes come from and if a card in the slot would be isolated
+	for _, slot := range append(append([]*PhysicalSlot{}, slots...), rootPorts...) {
+		slot.Lanes = getLanes(slot)
+		checkSlotIsolation(alldevs, slot)
+	}
+
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].Address < slots[j].Address
+	})
+
+	return slots, rootPorts
+}
+
+// Guesses if a slot gets its lanes from the CPU or the chipset.
+// Intel chipset root ports are device 0x10 and up on the root bus, AMD chipsets are a switch below a CPU root port
+func getLanes(slot *PhysicalSlot) string {
+	if slot.Port == "" {
+		return "unknown"
+	}
+
+	// The bridges from the root port down to the slot
+	bridges := append(getParentBridges(slot.Port), slot.Port)
+	rootPort := bridges[0]
+
+	switch readDeviceAttr(rootPort, "vendor") {
+	case "0x8086":
+		var domain, bus, device, function int
+		if _, err := fmt.Sscanf(rootPort, "%04x:%02x:%02x.%x", &domain, &bus, &device, &function); err != nil {
+			return "unknown"
+		}
+		if device >= 0x10 {
+			return "chipset"
+		}
+		return "CPU"
+
+	case "0x1022":
+		// AMD and ASMedia made chipsets show up as a switch below the root port
+		for _, bridge := range bridges[1:] {
+			switch readDeviceAttr(bridge, "vendor") {
+			case "0x1022", "0x1b21":
+				return "chipset"
+			}
+		}
+		return "CPU"
+	}
+
+	return "unknown"
+}
+
+// Checks if the devices in a slot get their own IOMMU group. Occupied slots are checked with the current groups,
+// empty slots are predicted from the ACS state of the bridges above them (needs root)
+func checkSlotIsolation(alldevs *IOMMU, slot *PhysicalSlot) {
+	inSlot := make(map[string]bool)
+	for _, device := range slot.Devices {
+		inSlot[device.Address] = true
+	}
+
+	// Use the groups of the devices in the slot if there are any
+	if len(slot.Devices) > 0 && !alldevs.Predicted {
+		slot.Known = true
+		seen := make(map[string]bool)
+		for _, device := range slot.Devices {
+			group, _ := alldevs.FindDevice(device.Address)
+			for _, mate := range sortDevices(mapDevices(group.Devices)) {
+				if !inSlot[mate.Address] && !isBridge(mate) && !seen[mate.Address] {
+					seen[mate.Address] = true
+					slot.SharesWith = append(slot.SharesWith, mate)
+				}
+			}
+		}
+		slot.Isolated = len(slot.SharesWith) == 0
+		if !slot.Isolated {
+			slot.Reason = "the devices in it share their IOMMU group with devices outside of it"
+		}
+		return
+	}
+
+	// A slot on the root bus gets its own group unless the card is a multi-function device without ACS
+	if slot.Port == "" {
+		slot.Known = true
+		slot.Isolated = true
+		return
+	}
+
+	// Else check if the path from the port to the root complex isolates
+	var bridges []*acsStatus
+	for _, bridge := range append(getParentBridges(slot.Port), slot.Port) {
+		bridges = append(bridges, getACSStatus(bridge))
+	}
+	if !bridges[0].Readable {
+		return
+	}
+	slot.Known = true
+
+	anchor, culprits := findGroupingBridge(bridges)
+	if anchor == nil {
+		slot.Isolated = true
+		return
+	}
+
+	// A card in the slot would join the group of the anchor, and everything in it
+	if group, _ := alldevs.FindDevice(anchor.Address); group != nil {
+		for _, mate := range sortDevices(mapDevices(group.Devices)) {
+			if !inSlot[mate.Address] && !isBridge(mate) {
+				slot.SharesWith = append(slot.SharesWith, mate)
+			}
+		}
+	}
+	var reasons []string
+	for _, culprit := range culprits {
+		reasons = append(reasons, fmt.Sprintf("%s (%s): %s", culprit.Address, pcieTypeName(culprit.PCIeType), culprit.reason()))
+	}
+	slot.Reason = fmt.Sprintf("the bridges above it do not isolate, %s", strings.Join(reasons, "; "))
+}
+
+// Generates the list of physical slots and root ports, with the isolation of each and the best empty slots if recommend is set
+func GenPhysicalSlots(slots []*PhysicalSlot, rootPorts []*PhysicalSlot, pArg *params.Params) []string {
+	var lines []string
+	recommend := pArg.Flag["recommend"]
+
+	lines = append(lines, "Physical slots:\n")
+	if len(slots) == 0 {
+		lines = append(lines, fmt.Sprintf("\tThe firmware does not describe any physical slots (%s is empty)\n", pciSlotsDir))
+	}
+	for _, slot := range slots {
+		port := "on the root bus"
+		if slot.Port != "" {
+			port = fmt.Sprintf("below %s", slot.Port)
+		}
+		lines = append(lines, fmt.Sprintf("\tSlot %s (%s) %s, %s lanes\n", slot.Name, slot.Address, port, slot.Lanes))
+		lines = append(lines, genSlotDetails(slot, recommend)...)
+	}
+
+	lines = append(lines, "Root ports:\n")
+	if len(rootPorts) == 0 {
+		lines = append(lines, "\tNo root ports found\n")
+	}
+	for _, port := range rootPorts {
+		lines = append(lines, fmt.Sprintf("\tRoot port %s, %s lanes\n", port.Port, port.Lanes))
+		lines = append(lines, genSlotDetails(port, recommend)...)
+	}
+
+	if !recommend {
+		return lines
+	}
+
+	// Recommend the empty slots that would give a card its own group, CPU lanes first
+	var best []*PhysicalSlot
+	for _, slot := range append(append([]*PhysicalSlot{}, slots...), rootPorts...) {
+		if len(slot.Devices) == 0 && slot.Known && slot.Isolated {
+			best = append(best, slot)
+		}
+	}
+	sort.SliceStable(best, func(i, j int) bool {
+		return best[i].Lanes == "CPU" && best[j].Lanes != "CPU"
+	})
+
+	lines = append(lines, "Recommended empty slots (a card in them gets its own IOMMU group):\n")
+	if len(best) == 0 {
+		lines = append(lines, "\tNone of the empty slots would give a card its own IOMMU group\n")
+	}
+	for _, slot := range best {
+		if slot.Name != "" {
+			lines = append(lines, fmt.Sprintf("\tSlot %s (%s), %s lanes\n", slot.Name, slot.Address, slot.Lanes))
+		} else {
+			lines = append(lines, fmt.Sprintf("\tRoot port %s, %s lanes\n", slot.Port, slot.Lanes))
+		}
+	}
+	lines = append(lines, "Multi-function cards without ACS share a group with their own functions in any slot.\n")
+
+	return lines
+}
+
+// Generates the devices in a slot, and its isolation if recommend is set
+func genSlotDetails(slot *PhysicalSlot, recommend bool) []string {
+	var lines []string
+
+	// Bridges in the slot are left out, they do not have to be passed through
+	empty := true
+	for _, device := range slot.Devices {
+		if !isBridge(device) {
+			lines = append(lines, fmt.Sprintf("\t\t%s\n", describeDevice(device)))
+			empty = false
+		}
+	}
+	if empty {
+		lines = append(lines, "\t\tempty\n")
+	}
+
+	if !recommend {
+		return lines
+	}
+
+	switch {
+	case !slot.Known:
+		lines = append(lines, "\t\tIsolation: unknown, the config space can not be read (run ls-iommu as root)\n")
+	case slot.Isolated:
+		lines = append(lines, "\t\tIsolation: devices in this slot get their own IOMMU group\n")
+	default:
+		lines = append(lines, fmt.Sprintf("\t\tIsolation: shared, %s\n", slot.Reason))
+		for _, device := range slot.SharesWith {
+			lines = append(lines, fmt.Sprintf("\t\t\t%s\n", describeDevice(device)))
+		}
+	}
+
+	return lines
+}
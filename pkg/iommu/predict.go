@@ -0,0 +1,190 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+/*
+	Predicts the IOMMU groups from the PCI topology and ACS, the same way the
+	kernel builds them (pci_device_group() in drivers/iommu/iommu.c):
+		- devices behind a PCIe to PCI bridge share the group of the bridge (DMA aliases)
+		- functions of a multi-function device without ACS share a group
+		- devices join the group of the highest bridge above them that is not isolated from the root complex
+		- devices the firmware (IVRS) gives an alias share the group of the alias
+		- devices no IOMMU unit in the firmware (DMAR) translates do not get a group
+	Device specific quirks in the kernel are not known to us, so the prediction can be off for some chipsets
+*/
+
+// Predicts the IOMMU group of every device, an ACS override can be given to predict the groups with it applied.
+// The predicted groups are numbered in the order of the PCI addresses, devices the IOMMU does not translate are left out
+func predictGroups(devices []*ghwpci.Device, override *acsOverride) map[string]int {
+	// Read the ACS state of every device once
+	statuses := make(map[string]*acsStatus)
+	for _, device := range devices {
+		status := getACSStatus(device.Address)
+		status.Overridden = override.applies(status)
+		statuses[device.Address] = status
+	}
+
+	// Get the state of a device, devices we do not know about are read as we go
+	getStatus := func(address string) *acsStatus {
+		if _, exists := statuses[address]; !exists {
+			status := getACSStatus(address)
+			status.Overridden = override.applies(status)
+			statuses[address] = status
+		}
+		return statuses[address]
+	}
+
+	// Join devices into groups with a union-find, every device starts in its own group
+	parent := make(map[string]string)
+	var find func(address string) string
+	find = func(address string) string {
+		if _, exists := parent[address]; !exists {
+			parent[address] = address
+		}
+		if parent[address] != address {
+			parent[address] = find(parent[address])
+		}
+		return parent[address]
+	}
+	union := func(a string, b string) {
+		parent[find(a)] = find(b)
+	}
+
+	for _, device := range devices {
+		status := getStatus(device.Address)
+		find(device.Address)
+
+		var bridges []*acsStatus
+		for _, bridge := range getParentBridges(device.Address) {
+			bridges = append(bridges, getStatus(bridge))
+		}
+
+		// Devices behind a PCIe to PCI bridge (or a conventional PCI bridge) are seen as the bridge by the IOMMU
+		for _, bridge := range bridges {
+			if bridge.PCIeType < 0 || bridge.PCIeType == pcieTypePCIeToPCI || bridge.PCIeType == pcieTypePCIToPCIe {
+				union(device.Address, bridge.Address)
+				break
+			}
+		}
+
+		// Functions of a multi-function device without ACS share a group with the other functions without ACS
+		if status.MultiFunction && !status.isolates() {
+			for _, other := range devices {
+				if other.Address != device.Address &&
+					slotAddress(other.Address) == slotAddress(device.Address) &&
+					!getStatus(other.Address).isolates() {
+					union(device.Address, other.Address)
+				}
+			}
+		}
+
+		// Join the group of the highest bridge that is not isolated from the root complex
+		if anchor, _ := findGroupingBridge(bridges); anchor != nil {
+			union(device.Address, anchor.Address)
+		}
+	}
+
+	// Devices the firmware gives an alias share a group with the alias, and with anything else using the same alias
+	var addresses []string
+	for _, device := range devices {
+		addresses = append(addresses, device.Address)
+	}
+	sort.Strings(addresses)
+	for address, alias := range getIVRSAliases(addresses) {
+		if _, exists := statuses[address]; exists {
+			union(address, alias)
+		}
+	}
+
+	// Number the groups in the order of the first PCI address in them
+	units := getDMARUnits()
+	groups := make(map[string]int)
+	numbers := make(map[string]int)
+	for _, address := range addresses {
+		if !isTranslated(units, address) {
+			continue
+		}
+		root := find(address)
+		if _, exists := numbers[root]; !exists {
+			numbers[root] = len(numbers)
+		}
+		groups[address] = numbers[root]
+	}
+
+	return groups
+}
+
+// Prints why the IOMMU is disabled to STDERR
+func printDiagnosis() {
+	fmt.Fprintln(os.Stderr, "IOMMU Disabled in UEFI/BIOS and/or not enabled in boot arguments!")
+	for _, line := range GenDiagnosis(DiagnoseIOMMU()) {
+		fmt.Fprint(os.Stderr, line)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// Returns what to call a group in the output, predicted groups are marked as such
+func groupLabel() string {
+	if predictedGroups {
+		return "Predicted Group"
+	}
+
+	return "IOMMU Group"
+}
+
+// Fills the IOMMU struct with predicted groups, used when the IOMMU is disabled and there are no groups to read
+func (i *IOMMU) predict(devices []*ghwpci.Device) {
+	// Without root we can not read ACS, so there is nothing to predict from and the diagnosis is all we can show
+	if len(devices) == 0 || !getACSStatus(devices[0].Address).Readable {
+		printDiagnosis()
+		fmt.Fprintln(os.Stderr, "ls-iommu needs root to predict the IOMMU groups, run it as root to see them.")
+		os.Exit(0)
+	}
+
+	// The override patch would be used if the IOMMU gets enabled with this command line
+	var override *acsOverride
+	if value := getCmdlineOverride(); value != "" {
+		override, _ = parseACSOverride(value)
+	}
+
+	groups := predictGroups(devices, override)
+	var untranslated []string
+	for _, device := range devices {
+		id, exists := groups[device.Address]
+		if !exists {
+			untranslated = append(untranslated, device.Address)
+			continue
+		}
+		if _, exists := i.Groups[id]; !exists {
+			i.AddGroup(NewGroup(id, make(map[string]*ghwpci.Device)))
+		}
+		i.Groups[id].AddDevice(device)
+	}
+	i.Predicted = true
+	predictedGroups = true
+
+	// Make it clear the groups are not real, only once since we read the groups more than once in some modes
+	if !warnedPrediction {
+		warnedPrediction = true
+		printDiagnosis()
+		source := "the PCI topology and ACS"
+		switch getFirmwareIOMMUTable() {
+		case "IVRS":
+			source = "the PCI topology, ACS and the aliases in the IVRS table"
+		case "DMAR":
+			source = "the PCI topology, ACS and the IOMMU units in the DMAR table"
+		}
+		fmt.Fprintf(os.Stderr, "The groups below are a PREDICTION made from %s, the real groups can differ.\n", source)
+		if len(untranslated) > 0 {
+			fmt.Fprintf(os.Stderr, "No IOMMU unit in the DMAR table translates %s, so they will not get a group.\n", strings.Join(untranslated, ", "))
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+}
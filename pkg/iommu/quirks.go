@@ -0,0 +1,76 @@
+package iommu
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/HikariKnight/ls-iommu/pkg/quirks"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// Gets the known problems of a device from the quirk table, with the conditions of the quirks checked
+func getQuirks(device *ghwpci.Device) []*quirks.Quirk {
+	var matches []*quirks.Quirk
+
+	for _, quirk := range quirks.Match(
+		device.Vendor.ID,
+		device.Product.ID,
+		deviceClassCode(device),
+		device.Subsystem.VendorID,
+		device.Subsystem.ID,
+	) {
+		switch quirk.Condition {
+		case "":
+		case "root_bus":
+			if len(getParentBridges(device.Address)) > 0 {
+				continue
+			}
+		case "no_other_functions":
+			functions, _ := filepath.Glob(fmt.Sprintf("/sys/bus/pci/devices/%s.*", slotAddress(device.Address)))
+			if len(functions) > 1 {
+				continue
+			}
+		default:
+			// A condition this version does not know about, better to not show the quirk than show it wrongly
+			continue
+		}
+		matches = append(matches, quirk)
+	}
+
+	return matches
+}
+
+// Gets the IDs of the known problems of a device
+func getQuirkIDs(device *ghwpci.Device) []string {
+	var ids []string
+	for _, quirk := range getQuirks(device) {
+		ids = append(ids, quirk.ID)
+	}
+
+	return ids
+}
+
+// Generates the known problems of a device and how to work around them, shown with -k
+func genQuirkInfo(device *ghwpci.Device) string {
+	var line string
+
+	for _, quirk := range getQuirks(device) {
+		label := "Known issue"
+		if quirk.Hint {
+			label = "Hint"
+		}
+		line = fmt.Sprintf("%s\t%s: %s\n", line, label, quirk.Summary)
+		line = fmt.Sprintf("%s\t\tWorkaround: %s\n", line, quirk.Mitigation)
+
+		// Check if the module working around the problem is loaded
+		if quirk.Module != "" {
+			state := "not loaded"
+			if isModuleLoaded(quirk.Module) {
+				state = "loaded"
+			}
+			line = fmt.Sprintf("%s\t\tModule %s: %s\n", line, quirk.Module, state)
+		}
+	}
+
+	return line
+}
@@ -0,0 +1,122 @@
+package iommu
+
+import (
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/where"
+	"github.com/jaypipes/ghw/pkg/pci"
+)
+
+// A structured record of a device and the IOMMU group it is in, used for filtering on device fields and the JSON output
+type Record struct {
+	Address   string  `json:"address"`
+	Group     int     `json:"group"`
+	Predicted bool    `json:"predicted,omitempty"`
+	VendorID  string  `json:"vendor_id"`
+	DeviceID  string  `json:"device_id"`
+	Class     string  `json:"class"`
+	ClassName string  `json:"class_name"`
+	Vendor    string  `json:"vendor"`
+	Product   string  `json:"product"`
+	Driver    string  `json:"driver"`
+	NUMA      int     `json:"numa"`
+	Isolated  bool    `json:"isolated"`
+	Viable    bool    `json:"viable"`
+	LinkSpeed float64 `json:"link_speed"`
+	BootVGA   bool    `json:"boot_vga"`
+	// The IDs of the known problems of the device from the quirk table
+	Quirks []string `json:"quirks,omitempty"`
+	// Only filled in for the JSON output since it has to read the config space
+	Reset *ResetInfo `json:"reset,omitempty"`
+	// Why the device is related to the devices it was found from with -r (ex: same slot as 0000:01:00.0),
+	// it has to be the last field so the labels can be merged like the ones of the device lines
+	Related []string    `json:"related,omitempty"`
+	Device  *pci.Device `json:"-"`
+}
+
+// The fields of a record that can be used in --where expressions and the kind of value they hold
+var recordFields = map[string]where.Kind{
+	"group":      where.Number,
+	"address":    where.Match,
+	"class":      where.Match,
+	"vendor_id":  where.Match,
+	"device_id":  where.Match,
+	"driver":     where.String,
+	"numa":       where.Number,
+	"isolated":   where.Bool,
+	"viable":     where.Bool,
+	"link_speed": where.Number,
+	"boot_vga":   where.Bool,
+}
+
+// Creates a record for a device in an IOMMU group, the group can be nil if it is unknown
+func NewRecord(group *Group, device *pci.Device) *Record {
+	record := &Record{
+		Group:     -1,
+		Address:   device.Address,
+		Predicted: predictedGroups,
+		VendorID:  device.Vendor.ID,
+		DeviceID:  device.Product.ID,
+		Class:     deviceClassCode(device),
+		ClassName: device.Subclass.Name,
+		Vendor:    device.Vendor.Name,
+		Product:   device.Product.Name,
+		Driver:    device.Driver,
+		NUMA:      getNUMANode(device.Address),
+		LinkSpeed: getLinkSpeed(device.Address),
+		BootVGA:   isBootVGA(device.Address),
+		Quirks:    getQuirkIDs(device),
+		Device:    device,
+	}
+
+	if group != nil {
+		record.Group = group.ID
+
+		// The device is isolated if every other device in the group is a bridge
+		record.Isolated = true
+		for _, other := range group.Devices {
+			if other.Address != device.Address && !isBridge(other) {
+				record.Isolated = false
+			}
+		}
+
+		// The group is viable for VFIO if nothing in it is bound to a driver that blocks it,
+		// predicted groups are never viable since VFIO can not use them
+		record.Viable = !predictedGroups && len(getGroupBlockers(group.ID)) == 0
+	}
+
+	return record
+}
+
+// Returns the values of the record for evaluating --where expressions
+func (r *Record) whereValues() map[string]interface{} {
+	return map[string]interface{}{
+		"group": float64(r.Group),
+		// PCI addresses can be given without the domain (ex: 01:00.0), the same way as --device and --exclude
+		"address": func(address string) bool {
+			return normalizeAddress(strings.TrimSpace(address)) == r.Address
+		},
+		// Classes are compared the same way as --class does it
+		"class": func(class string) bool {
+			return matchesClass(r.Device, class)
+		},
+		// IDs are compared as hex, so 0x10DE and 10de are the same
+		"vendor_id": func(id string) bool {
+			return normalizeHexID(id) == r.VendorID
+		},
+		"device_id": func(id string) bool {
+			return normalizeHexID(id) == r.DeviceID
+		},
+		"driver":     r.Driver,
+		"numa":       float64(r.NUMA),
+		"isolated":   r.Isolated,
+		"viable":     r.Viable,
+		"link_speed": r.LinkSpeed,
+		"boot_vga":   r.BootVGA,
+	}
+}
+
+// Normalizes a hex ID the way ghw gives them to us (ex: 0x10DE becomes 10de)
+func normalizeHexID(id string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+}
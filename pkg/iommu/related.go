@@ -0,0 +1,184 @@
+package iommu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// The reasons a device can be related to another device
+const (
+	relatedSameSlot   = "same slot"
+	relatedSameGroup  = "same IOMMU group"
+	relatedSameSwitch = "same PCIe switch"
+	relatedSameVendor = "same Vendor ID"
+)
+
+// Regex to find the related label at the end of the first line of a device entry
+var relatedLabelRegex = regexp.MustCompile(` \[related: ([^\]]*)\]\n`)
+
+// Regex to find the related field at the end of a JSON record
+var relatedJSONRegex = regexp.MustCompile(`,"related":\[([^\]]*)\]\}\n`)
+
+// Find devices related to a device by topology: other functions in the same slot, devices in the same IOMMU group
+// and devices below the same PCIe switch. With -rr (related > 1) devices sharing the Vendor ID are also included.
+// Every device found is labelled with why it is related
+func findRelatedDevices(device *ghwpci.Device, related int, pArg *params.Params) []string {
+	// Make a string slice for our output
+	var devs []string
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	// Get what we need to know about the device to find its relatives
+	group, _ := alldevs.FindDevice(device.Address)
+	slot := slotAddress(device.Address)
+	upstream := getSwitchUpstreamPort(device.Address)
+
+	// Iterate through the groups, group numbers can have gaps so we range over them
+	for id, otherGroup := range alldevs.Groups {
+		// For each device
+		for _, other := range otherGroup.Devices {
+			// A device is not related to itself
+			if other.Address == device.Address {
+				continue
+			}
+
+			// Find out why the device is related, if it is
+			var reasons []string
+			if slotAddress(other.Address) == slot {
+				reasons = append(reasons, relatedSameSlot)
+			}
+			if group != nil && group.ID == id {
+				reasons = append(reasons, relatedSameGroup)
+			}
+			if upstream != "" && !isBridge(other) && isBelow(other.Address, upstream) {
+				reasons = append(reasons, relatedSameSwitch)
+			}
+			if related > 1 && other.Vendor.ID == device.Vendor.ID {
+				reasons = append(reasons, relatedSameVendor)
+			}
+
+			// Skip devices that are not related or do not pass the filters
+			if len(reasons) == 0 || !filterDevice(otherGroup, other, pArg) {
+				continue
+			}
+
+			// Ignore the Vendor IDs given with -R unless the device is in the same IOMMU group
+			if (group == nil || group.ID != id) && isIgnoredVendor(other, pArg) {
+				continue
+			}
+
+			devs = append(devs, genRelatedLine(otherGroup, other, device, reasons, pArg)...)
+		}
+	}
+
+	return devs
+}
+
+// Checks if the Vendor ID of a device was given with -R/--ignore
+func isIgnoredVendor(device *ghwpci.Device, pArg *params.Params) bool {
+	for _, ignore := range pArg.StringList["ignore"] {
+		if ignore == device.Vendor.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if a device is somewhere below a bridge
+func isBelow(address string, bridge string) bool {
+	for _, parent := range getParentBridges(address) {
+		if parent == bridge {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Generates the output for a related device, labelled with why it is related to the device we searched from
+func genRelatedLine(group *Group, device *ghwpci.Device, relative *ghwpci.Device, reasons []string, pArg *params.Params) []string {
+	label := fmt.Sprintf("%s as %s", strings.Join(reasons, ", "), relative.Address)
+
+	// The JSON record gets the label in its related field
+	if pArg.Flag["json"] {
+		warnBootVGA(device, pArg)
+		return []string{genJSONRecord(group, device, []string{label})}
+	}
+
+	// If --id, --pciaddr or --rom is given we keep the output plain so it can be used in scripts,
+	// the legacy output stays the same as the bash script
+	if pArg.Flag["id"] || pArg.Flag["pciaddr"] || pArg.Flag["rom"] || pArg.Flag["legacyoutput"] {
+		return genDeviceOutput(group, device, pArg)
+	}
+
+	line := generateDevList(group.ID, device, pArg)
+
+	// Label the first line of the device entry
+	return []string{strings.Replace(line, "\n", fmt.Sprintf(" [related: %s]\n", label), 1)}
+}
+
+// Merges the labels of related devices that were found multiple times, if the device was also
+// listed without a label (because it was searched for directly) the labelled entries are dropped.
+// Works on both the device lines and the JSON records
+func mergeRelatedLabels(lines []string) []string {
+	var entries, output []string
+	labels := make(map[string][]string)
+	unlabelled := make(map[string]bool)
+
+	// Find the labels of every entry
+	for _, line := range lines {
+		var entry string
+		var label string
+		if match := relatedLabelRegex.FindStringSubmatch(line); match != nil {
+			entry, label = strings.Replace(line, match[0], "\n", 1), match[1]
+		} else if match := relatedJSONRegex.FindStringSubmatch(line); match != nil {
+			entry, label = strings.Replace(line, match[0], "}\n", 1), match[1]
+		} else {
+			unlabelled[line] = true
+			continue
+		}
+
+		if _, exists := labels[entry]; !exists {
+			entries = append(entries, entry)
+		}
+		labels[entry] = appendUnique(labels[entry], label)
+	}
+
+	// Put the merged labels back on the entries that were not listed without a label
+	for _, entry := range entries {
+		switch {
+		case unlabelled[entry]:
+			continue
+		case strings.HasPrefix(entry, "{"):
+			output = append(output, strings.Replace(entry, "}\n", fmt.Sprintf(",\"related\":[%s]}\n", strings.Join(labels[entry], ",")), 1))
+		default:
+			output = append(output, strings.Replace(entry, "\n", fmt.Sprintf(" [related: %s]\n", strings.Join(labels[entry], "; ")), 1))
+		}
+	}
+
+	// Add the unlabelled lines
+	for _, line := range lines {
+		if unlabelled[line] {
+			output = append(output, line)
+		}
+	}
+
+	return output
+}
+
+// Appends a string to a slice if it is not already in it
+func appendUnique(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+
+	return append(list, value)
+}
@@ -0,0 +1,267 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Devices have to be reset between VM boots, a device that can not be reset
+	often only works once per host boot. The kernel can reset a device with:
+		flr: Function Level Reset, from the PCIe or the Advanced Features capability
+		pm:  putting the device in D3hot and back, only resets it if NoSoftRst is not set
+		bus: a secondary bus reset on the bridge above, which resets everything on the bus
+*/
+
+// Capability IDs and offsets used for resets
+const (
+	capIDPM = 0x01
+	capIDAF = 0x13
+
+	// Device Capabilities register in the PCIe capability and the FLR bit in it
+	pcieDevCap    = 0x04
+	pcieDevCapFLR = 1 << 28
+
+	// Capabilities in the AF capability and the bits in it
+	afCap    = 0x03
+	afCapTP  = 0x01
+	afCapFLR = 0x02
+
+	// Power Management Control/Status register in the PM capability and the NoSoftRst bit in it
+	pmCtrl          = 0x04
+	pmCtrlNoSoftRst = 0x08
+)
+
+// What a device supports to reset it
+type ResetInfo struct {
+	// The reset methods the kernel will try in order, from sysfs (ex: flr, bus)
+	Methods []string `json:"methods"`
+	// If the config space past the header could be read (needs root), the rest is only known if it could
+	Readable bool `json:"readable"`
+	// FLR from the PCIe capability
+	FLR bool `json:"flr"`
+	// FLR from the Advanced Features capability
+	AFFLR bool `json:"af_flr"`
+	// If the device has a power management capability
+	PM bool `json:"pm"`
+	// If NoSoftRst is set, the device is not reset when going from D3hot to D0
+	NoSoftRst bool `json:"no_soft_reset"`
+	// If there is a bridge above the device that can do a secondary bus reset
+	BusReset bool `json:"bus_reset"`
+	// The other devices on the bus that a bus reset would reset as well
+	BusResetAffects []string `json:"bus_reset_affects"`
+}
+
+// Gets the reset support of a device
+func getResetInfo(address string) *ResetInfo {
+	config := readConfig(address)
+	info := &ResetInfo{
+		Methods:         getResetMethods(address),
+		Readable:        len(config) > 0x40,
+		BusResetAffects: []string{},
+	}
+
+	if offset := findCapability(config, capIDPCIe); offset != 0 {
+		info.FLR = readConfig32(config, offset+pcieDevCap)&pcieDevCapFLR != 0
+	}
+	if offset := findCapability(config, capIDAF); offset != 0 && offset+afCap < len(config) {
+		info.AFFLR = config[offset+afCap]&afCapTP != 0 && config[offset+afCap]&afCapFLR != 0
+	}
+	if offset := findCapability(config, capIDPM); offset != 0 {
+		info.PM = true
+		info.NoSoftRst = readConfig16(config, offset+pmCtrl)&pmCtrlNoSoftRst != 0
+	}
+
+	// A bus reset needs a bridge above the device and resets everything on the bus below that bridge
+	info.BusReset = len(getParentBridges(address)) > 0
+	if info.BusReset {
+		info.BusResetAffects = getDevicesOnBus(address)
+	}
+
+	return info
+}
+
+// Gets the reset methods the kernel will use from sysfs, returns an empty list if the device can not be reset.
+// Older kernels only have the reset file, so the methods are unknown and nil is returned
+func getResetMethods(address string) []string {
+	if methods := readDeviceAttr(address, "reset_method"); methods != "" {
+		return strings.Fields(methods)
+	}
+
+	// The reset file only exists if the kernel can reset the device
+	if _, err := os.Stat(fmt.Sprintf("/sys/bus/pci/devices/%s/reset", address)); err == nil {
+		return nil
+	}
+
+	return []string{}
+}
+
+// Gets the other devices on the same bus as a device, they are reset along with it by a bus reset
+func getDevicesOnBus(address string) []string {
+	others := []string{}
+
+	// The bus is everything before the last : in the address (ex: 0000:01)
+	bus := address[:strings.LastIndex(address, ":")]
+	devices, _ := filepath.Glob(fmt.Sprintf("/sys/bus/pci/devices/%s:*", bus))
+	for _, device := range devices {
+		if other := filepath.Base(device); other != address {
+			others = append(others, other)
+		}
+	}
+
+	return others
+}
+
+// Generates the reset info shown with -k (ex: Reset methods: flr bus, FLR+ AF-FLR- NoSoftRst- BusReset+)
+func genResetInfo(address string) string {
+	info := getResetInfo(address)
+
+	methods := "none"
+	if info.Methods == nil {
+		methods = "unknown"
+	} else if len(info.Methods) > 0 {
+		methods = strings.Join(info.Methods, " ")
+	}
+	line := fmt.Sprintf("\tReset methods: %s\n", methods)
+
+	// The capabilities can only be read as root
+	if !info.Readable {
+		return line
+	}
+
+	flags := []string{
+		"FLR" + plusMinus(info.FLR),
+		"AF-FLR" + plusMinus(info.AFFLR),
+	}
+	if info.PM {
+		flags = append(flags, "NoSoftRst"+plusMinus(info.NoSoftRst))
+	}
+	flags = append(flags, "BusReset"+plusMinus(info.BusReset))
+	line = fmt.Sprintf("%s\tReset support: %s\n", line, strings.Join(flags, " "))
+
+	if len(info.BusResetAffects) > 0 {
+		line = fmt.Sprintf("%s\tBus reset also resets: %s\n", line, strings.Join(info.BusResetAffects, ", "))
+	}
+
+	return line
+}
+
+// Returns + or - the same way lspci shows flags
+func plusMinus(set bool) string {
+	if set {
+		return "+"
+	}
+
+	return "-"
+}
+
+// The reset methods the --method argument can select and the kernel methods they map to, in order of preference
+var resetMethodNames = map[string][]string{
+	"flr": {"flr", "af_flr"},
+	"pm":  {"pm"},
+	"bus": {"bus"},
+}
+
+// Resets a device through sysfs, with the given method or the methods the kernel would use if none is given.
+// Refuses to reset devices bound to a driver other than vfio-pci unless forced, and bus resets that would reset other devices
+func ResetDevice(address string, method string, force bool) ([]string, error) {
+	var lines []string
+
+	// Check if the device exists, PCI addresses can be given without the domain (ex: 01:00.0)
+	address = normalizeAddress(address)
+	device := fmt.Sprintf("/sys/bus/pci/devices/%s", address)
+	if _, err := os.Stat(device); err != nil {
+		return lines, fmt.Errorf("PCI device %s does not exist", address)
+	}
+
+	// Resetting a device under a driver that is using it can crash the driver or the host
+	driver := ""
+	if link, err := filepath.EvalSymlinks(filepath.Join(device, "driver")); err == nil {
+		driver = filepath.Base(link)
+	}
+	if driver != "" && driver != "vfio-pci" && !force {
+		return lines, fmt.Errorf("%s is bound to %s, bind it to vfio-pci first or use --force to reset it anyway", address, driver)
+	}
+
+	info := getResetInfo(address)
+	if info.Methods != nil && len(info.Methods) == 0 {
+		return lines, fmt.Errorf("the kernel does not know any way to reset %s", address)
+	}
+
+	// Find the kernel method for the method we were given
+	kernelMethod := ""
+	if method != "" {
+		for _, name := range resetMethodNames[method] {
+			if info.Methods == nil || containsMethod(info.Methods, name) {
+				kernelMethod = name
+				break
+			}
+		}
+		if kernelMethod == "" {
+			return lines, fmt.Errorf("%s can not be reset with %s, the kernel supports: %s", address, method, strings.Join(info.Methods, ", "))
+		}
+	}
+
+	// A bus reset resets everything on the bus, never do that to other devices
+	if (kernelMethod == "bus" || (kernelMethod == "" && len(info.Methods) > 0 && info.Methods[0] == "bus")) && len(info.BusResetAffects) > 0 {
+		return lines, fmt.Errorf("a bus reset of %s would also reset %s", address, strings.Join(info.BusResetAffects, ", "))
+	}
+
+	before := readConfig(address)
+
+	// Select the method, and put back the methods the kernel used before when we are done
+	if kernelMethod != "" {
+		if info.Methods == nil {
+			return lines, fmt.Errorf("this kernel does not support selecting a reset method, run the reset without --method")
+		}
+		if err := writeDeviceAttr(address, "reset_method", kernelMethod); err != nil {
+			return lines, err
+		}
+		defer writeDeviceAttr(address, "reset_method", strings.Join(info.Methods, " "))
+	}
+
+	if err := writeDeviceAttr(address, "reset", "1"); err != nil {
+		return lines, err
+	}
+
+	used := kernelMethod
+	if used == "" {
+		used = "the default methods"
+		if info.Methods != nil {
+			used = fmt.Sprintf("the default methods (%s)", strings.Join(info.Methods, ", "))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Reset %s with %s\n", address, used))
+
+	// Make sure the device came back by reading the Vendor ID and Device ID again
+	after := readConfig(address)
+	if len(before) < 4 || len(after) < 4 {
+		return lines, fmt.Errorf("unable to read the config space of %s to verify the reset", address)
+	}
+	if readConfig32(after, 0) == 0xffffffff {
+		return lines, fmt.Errorf("%s does not respond after the reset", address)
+	}
+	if readConfig32(after, 0) != readConfig32(before, 0) {
+		return lines, fmt.Errorf("%s responds with different IDs after the reset", address)
+	}
+	lines = append(lines, fmt.Sprintf(
+		"The device responds after the reset [%04x:%04x]\n",
+		readConfig16(after, 0),
+		readConfig16(after, 2),
+	))
+
+	return lines, nil
+}
+
+// Checks if the kernel lists a reset method
+func containsMethod(methods []string, method string) bool {
+	for _, name := range methods {
+		if name == method {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package iommu
+
+import (
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// Maps a device selector flag to the subclass names it should match
+type Selector struct {
+	Flag       string
+	Subclasses []string
+}
+
+// All device selector flags, add new selectors here and they can be combined with the others
+var Selectors = []Selector{
+	// GPUs and 3D controllers
+	{Flag: "gpu", Subclasses: []string{`VGA`, `3D`}},
+	// USB controllers
+	{Flag: "usb", Subclasses: []string{`USB controller`}},
+	// Ethernet and Wi-Fi controllers
+	{Flag: "nic", Subclasses: []string{`Ethernet controller`, `Network controller`}},
+	// SATA controllers
+	{Flag: "sata", Subclasses: []string{`SATA controller`}},
+	// NVMe controllers
+	{Flag: "nvme", Subclasses: []string{`Non-Volatile memory controller`}},
+	// Audio devices
+	{Flag: "audio", Subclasses: []string{`Audio device`}},
+}
+
+// Returns true if any device selector flag was passed
+func HasSelector(pArg *params.Params) bool {
+	for _, selector := range Selectors {
+		if pArg.Flag[selector.Flag] {
+			return true
+		}
+	}
+
+	// --class also works as a device selector
+	return len(pArg.StringList["class"]) > 0
+}
+
+// Gets the devices for every device selector flag passed and returns them as one list
+func MatchSelectors(pArg *params.Params) []string {
+	var devs []string
+
+	// For each selector the user asked for
+	for _, selector := range Selectors {
+		if pArg.Flag[selector.Flag] {
+			// Get all devices matching the subclasses of the selector
+			for _, subclass := range selector.Subclasses {
+				devs = append(devs, MatchSubclass(subclass, pArg)...)
+			}
+		}
+	}
+
+	// Get all devices matching the classes given with --class
+	for _, class := range pArg.StringList["class"] {
+		devs = append(devs, MatchClass(class, pArg)...)
+	}
+
+	return devs
+}
+
+// Checks if a device is matched by the device selectors given, every device matches if no selector was given
+func matchesSelectors(device *ghwpci.Device, pArg *params.Params) bool {
+	if !HasSelector(pArg) {
+		return true
+	}
+
+	// Check the selector flags
+	for _, selector := range Selectors {
+		if pArg.Flag[selector.Flag] {
+			for _, subclass := range selector.Subclasses {
+				if strings.Contains(device.Subclass.Name, subclass) {
+					return true
+				}
+			}
+		}
+	}
+
+	// Check the classes given with --class
+	for _, class := range pArg.StringList["class"] {
+		if matchesClass(device, class) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+	vfio-pci.ids binds every device with the given VendorID:DeviceID, so if the
+	host has a second identical GPU or NIC it gets bound to vfio-pci as well.
+	driver_override only binds the devices at the PCI addresses it is written to
+*/
+
+// Splits the --id output lines (ex: 10de:1b80<tab>0000:01:00.0) into the unique IDs to print and the PCI addresses
+func splitIDLines(lines []string) ([]string, []string) {
+	var ids, addresses []string
+	seen := make(map[string]bool)
+
+	for _, line := range lines {
+		id, address, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "\t")
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, fmt.Sprintf("%s\n", id))
+		}
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return ids, addresses
+}
+
+// Gets the VendorID:DeviceID of a PCI device from sysfs (ex: 10de:1b80)
+func getDeviceID(address string) string {
+	return fmt.Sprintf(
+		"%s:%s",
+		strings.TrimPrefix(readDeviceAttr(address, "vendor"), "0x"),
+		strings.TrimPrefix(readDeviceAttr(address, "device"), "0x"),
+	)
+}
+
+// Gets the devices that have the same VendorID:DeviceID as a selected device but were not selected, mapped by the IDs
+func getSharedIDs(selected []string) map[string][]string {
+	shared := make(map[string][]string)
+
+	// The IDs of the selected devices
+	ids := make(map[string]bool)
+	isSelected := make(map[string]bool)
+	for _, address := range selected {
+		ids[getDeviceID(address)] = true
+		isSelected[address] = true
+	}
+
+	// Check every PCI device against them
+	devices, _ := filepath.Glob("/sys/bus/pci/devices/*")
+	for _, path := range devices {
+		address := filepath.Base(path)
+		if isSelected[address] {
+			continue
+		}
+
+		if id := getDeviceID(address); ids[id] {
+			shared[id] = append(shared[id], address)
+		}
+	}
+
+	for id := range shared {
+		sort.Strings(shared[id])
+	}
+
+	return shared
+}
+
+// Warns on STDERR if the IDs printed with --id also belong to devices that were not selected,
+// and shows how to bind only the selected devices with driver_override instead
+func warnSharedIDs(selected []string) {
+	shared := getSharedIDs(selected)
+	if len(shared) == 0 {
+		return
+	}
+
+	var ids []string
+	for id := range shared {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "WARNING: vfio-pci.ids binds every device with these IDs, including devices you did not select:")
+	for _, id := range ids {
+		fmt.Fprintf(os.Stderr, "\t%s is also used by %s\n", id, strings.Join(shared[id], ", "))
+	}
+
+	// driver_override has to be set before vfio-pci loads, so we do it when modprobe loads it
+	addresses := removeDuplicateLines(selected)
+	sort.Strings(addresses)
+
+	fmt.Fprintln(os.Stderr, "Do not use vfio-pci.ids, bind the selected devices by their PCI address with driver_override instead.")
+	fmt.Fprintln(os.Stderr, "For example with this in /etc/modprobe.d/vfio.conf (and vfio-pci added to the initramfs):")
+	fmt.Fprintf(
+		os.Stderr,
+		"\tinstall vfio-pci /bin/sh -c 'for dev in %s; do echo vfio-pci > /sys/bus/pci/devices/$dev/driver_override; done; modprobe -i vfio-pci'\n",
+		strings.Join(addresses, " "),
+	)
+}
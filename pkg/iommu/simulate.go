@@ -0,0 +1,226 @@
+package iommu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	"github.com/jaypipes/ghw"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+/*
+	The pcie_acs_override kernel patch makes the kernel pretend devices without an ACS
+	capability isolate the devices below them, it takes a comma separated list of:
+		downstream:          root ports and switch downstream ports
+		multifunction:       functions of multi-function devices
+		id:vvvv:dddd:        devices with the given Vendor ID and Device ID
+	Devices that have an ACS capability are never overridden
+*/
+
+// The override variants we simulate if none is given
+var overrideVariants = []string{"downstream", "multifunction", "downstream,multifunction"}
+
+// Regex to check an id: option of pcie_acs_override (ex: id:8086:1901)
+var overrideIDRegex = regexp.MustCompile(`^id:[0-9a-f]{4}:[0-9a-f]{4}$`)
+
+// A parsed pcie_acs_override value
+type acsOverride struct {
+	Downstream    bool
+	MultiFunction bool
+	IDs           []string
+}
+
+// Parses the value of pcie_acs_override (ex: downstream,multifunction)
+func parseACSOverride(value string) (*acsOverride, error) {
+	override := &acsOverride{}
+
+	for _, option := range strings.Split(strings.ToLower(value), ",") {
+		switch {
+		case option == "downstream":
+			override.Downstream = true
+		case option == "multifunction":
+			override.MultiFunction = true
+		case overrideIDRegex.MatchString(option):
+			override.IDs = append(override.IDs, strings.TrimPrefix(option, "id:"))
+		default:
+			return nil, fmt.Errorf("unknown pcie_acs_override option %q, valid options are downstream, multifunction and id:vvvv:dddd", option)
+		}
+	}
+
+	return override, nil
+}
+
+// Checks if the override makes a device count as isolating, the same way the patch decides it
+func (o *acsOverride) applies(status *acsStatus) bool {
+	// Conventional PCI devices and devices with an ACS capability are never overridden
+	if o == nil || !status.Readable || status.PCIeType < 0 || status.HasACS {
+		return false
+	}
+
+	for _, id := range o.IDs {
+		if id == status.ID {
+			return true
+		}
+	}
+
+	switch status.PCIeType {
+	case pcieTypeRootPort, pcieTypeDownstream:
+		return o.Downstream
+	case pcieTypeEndpoint, pcieTypeUpstream, pcieTypeLegacyEndpoint, pcieTypeRCEndpoint:
+		return o.MultiFunction && status.MultiFunction
+	}
+
+	return false
+}
+
+// Gets the value of pcie_acs_override from the kernel command line, returns an empty string if it is not set
+func getCmdlineOverride() string {
+	for _, arg := range strings.Fields(readFile("/proc/cmdline")) {
+		if strings.HasPrefix(arg, "pcie_acs_override=") {
+			return strings.TrimPrefix(arg, "pcie_acs_override=")
+		}
+	}
+
+	return ""
+}
+
+// Simulates the IOMMU groups with pcie_acs_override and shows them side by side with the current groups.
+// If no variant is given, the common variants are simulated
+func SimulateOverrides(variant string, pArg *params.Params) ([]string, error) {
+	var lines []string
+
+	// Use the variant given, else the common ones and whatever is on the kernel command line
+	active := getCmdlineOverride()
+	variants := append([]string{}, overrideVariants...)
+	if variant != "" {
+		variants = []string{variant}
+	} else if active != "" {
+		variants = appendUnique(variants, active)
+	}
+
+	// Parse the variants before doing any work
+	overrides := []*acsOverride{nil}
+	for _, variant := range variants {
+		override, err := parseACSOverride(variant)
+		if err != nil {
+			return lines, err
+		}
+		overrides = append(overrides, override)
+	}
+
+	// Get all IOMMU devices and all PCI devices
+	alldevs := NewIOMMU()
+	pci, err := ghw.PCI(ghw.WithDisableWarnings())
+	errorcheck.ErrorCheck(err, "Failed to parse PCI devices")
+	devices := sortDevices(append([]*ghwpci.Device{}, pci.Devices...))
+
+	// The ACS capabilities are past the part of the config space everyone can read
+	if len(devices) > 0 && !getACSStatus(devices[0].Address).Readable {
+		return lines, fmt.Errorf("simulating the IOMMU groups needs to read the PCI config space, run ls-iommu as root")
+	}
+
+	// Predict the groups for every variant, the first prediction is without an override
+	var predictions []map[string]int
+	for _, override := range overrides {
+		predictions = append(predictions, predictGroups(devices, override))
+	}
+
+	// Tell the user if the current groups are already made with an override
+	if active != "" {
+		lines = append(lines, fmt.Sprintf("pcie_acs_override=%s is active on the kernel command line, the current groups already use it\n", active))
+	} else {
+		lines = append(lines, "pcie_acs_override is not set on the kernel command line\n")
+	}
+	lines = append(lines, "Predicted groups are numbered by PCI address, devices with the same number in a column share a group.\n")
+	lines = append(lines, "Chipset specific quirks in the kernel are not known to ls-iommu, so some predictions can be off.\n\n")
+
+	// Make the header, every column is as wide as its name
+	headers := append([]string{"Current", "No override"}, variants...)
+	lines = append(lines, fmt.Sprintf("%s  Device\n", strings.Join(headers, "  ")))
+
+	// Make a row for every device we want to see
+	for _, device := range devices {
+		group, _ := alldevs.FindDevice(device.Address)
+		current := -1
+		if group != nil && !alldevs.Predicted {
+			current = group.ID
+		}
+
+		// Skip devices that are not selected or do not pass the filters
+		if group != nil && !isSelectedGroup(group.ID, pArg) {
+			continue
+		}
+		if HasSelector(pArg) && !matchesSelectors(device, pArg) {
+			continue
+		}
+		if !filterDevice(group, device, pArg) {
+			continue
+		}
+
+		columns := []string{simulationColumn(current, headers[0])}
+		for i, prediction := range predictions {
+			columns = append(columns, simulationColumn(prediction[device.Address], headers[i+1]))
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s\n", strings.Join(columns, "  "), describeDevice(device)))
+	}
+
+	// Summarize how many groups there are and how many devices are isolated for each column
+	currentGroups := make(map[string]int)
+	for _, device := range devices {
+		if group, _ := alldevs.FindDevice(device.Address); group != nil && !alldevs.Predicted {
+			currentGroups[device.Address] = group.ID
+		}
+	}
+	groupCounts := []string{simulationColumn(countGroups(currentGroups), headers[0])}
+	isolatedCounts := []string{simulationColumn(countIsolated(devices, currentGroups), headers[0])}
+	for i, prediction := range predictions {
+		groupCounts = append(groupCounts, simulationColumn(countGroups(prediction), headers[i+1]))
+		isolatedCounts = append(isolatedCounts, simulationColumn(countIsolated(devices, prediction), headers[i+1]))
+	}
+	lines = append(lines, "\n")
+	lines = append(lines, fmt.Sprintf("%s  IOMMU groups\n", strings.Join(groupCounts, "  ")))
+	lines = append(lines, fmt.Sprintf("%s  Isolated devices (not counting bridges)\n", strings.Join(isolatedCounts, "  ")))
+
+	return lines, nil
+}
+
+// Right aligns a number in a column as wide as the header, -1 is shown as -
+func simulationColumn(value int, header string) string {
+	if value < 0 {
+		return fmt.Sprintf("%*s", len(header), "-")
+	}
+
+	return fmt.Sprintf("%*d", len(header), value)
+}
+
+// Counts the groups in a grouping
+func countGroups(groups map[string]int) int {
+	seen := make(map[int]bool)
+	for _, group := range groups {
+		seen[group] = true
+	}
+
+	return len(seen)
+}
+
+// Counts the devices that are not bridges and do not share their group with anything but bridges
+func countIsolated(devices []*ghwpci.Device, groups map[string]int) int {
+	members := make(map[int]int)
+	for _, device := range devices {
+		if group, exists := groups[device.Address]; exists && !isBridge(device) {
+			members[group]++
+		}
+	}
+
+	isolated := 0
+	for _, count := range members {
+		if count == 1 {
+			isolated++
+		}
+	}
+
+	return isolated
+}
@@ -0,0 +1,135 @@
+package iommu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+	ghwpci "github.com/jaypipes/ghw/pkg/pci"
+)
+
+// A PCI slot (domain:bus:device) and all the functions in it
+type Slot struct {
+	Address   string
+	Functions []*SlotFunction
+}
+
+// A function in a slot and the IOMMU group it is in
+type SlotFunction struct {
+	Group  int
+	Device *ghwpci.Device
+}
+
+// Gets the IOMMU groups the functions of the slot are in, sorted
+func (s *Slot) Groups() []int {
+	var groups []int
+	seen := make(map[int]bool)
+
+	for _, function := range s.Functions {
+		if !seen[function.Group] {
+			seen[function.Group] = true
+			groups = append(groups, function.Group)
+		}
+	}
+	sort.Ints(groups)
+
+	return groups
+}
+
+// Checks if the functions of the slot are split across multiple IOMMU groups
+func (s *Slot) SplitGroups() bool {
+	return len(s.Groups()) > 1
+}
+
+// Gets the slots of the devices selected by the arguments given (selectors, -i and filters),
+// every slot contains all of its functions even if only one of them was selected
+func GetSlots(pArg *params.Params) []*Slot {
+	var slots []*Slot
+
+	// Get all IOMMU devices
+	alldevs := NewIOMMU()
+
+	// Put every device into its slot and keep track of which slots have a selected device
+	bySlot := make(map[string]*Slot)
+	selected := make(map[string]bool)
+	for id, group := range alldevs.Groups {
+		for _, device := range group.Devices {
+			address := slotAddress(device.Address)
+			if _, exists := bySlot[address]; !exists {
+				bySlot[address] = &Slot{Address: address}
+			}
+			bySlot[address].Functions = append(bySlot[address].Functions, &SlotFunction{Group: id, Device: device})
+
+			// Check if the device is selected
+			if isSelectedGroup(id, pArg) && matchesSelectors(device, pArg) && filterDevice(group, device, pArg) {
+				selected[address] = true
+			}
+		}
+	}
+
+	// Only keep the selected slots, sorted by their address and with the functions in order
+	for address, slot := range bySlot {
+		if selected[address] {
+			sort.Slice(slot.Functions, func(i, j int) bool {
+				return slot.Functions[i].Device.Address < slot.Functions[j].Device.Address
+			})
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].Address < slots[j].Address
+	})
+
+	return slots
+}
+
+// Checks if an IOMMU group was selected with -i, every group is selected if -i was not given
+func isSelectedGroup(id int, pArg *params.Params) bool {
+	if len(pArg.IntList["iommu_group"]) == 0 {
+		return true
+	}
+
+	for _, group := range pArg.IntList["iommu_group"] {
+		if group == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Generates the slot view, one entry per slot with a line for each function
+func GenSlotView(slots []*Slot) []string {
+	var lines []string
+
+	for _, slot := range slots {
+		// List the IOMMU groups of the slot and warn if the functions are split across groups
+		var groups []string
+		for _, group := range slot.Groups() {
+			groups = append(groups, fmt.Sprintf("%d", group))
+		}
+		header := fmt.Sprintf("Slot %s (IOMMU Groups: %s)", slot.Address, strings.Join(groups, ", "))
+		if slot.SplitGroups() {
+			header = fmt.Sprintf("%s [functions split across IOMMU groups]", header)
+		}
+		lines = append(lines, fmt.Sprintf("%s\n", header))
+
+		// Add a line for each function with its class, driver and group
+		for _, function := range slot.Functions {
+			driver := function.Device.Driver
+			if driver == "" {
+				driver = "none"
+			}
+			lines = append(lines, fmt.Sprintf(
+				"\t%s, driver: %s, %s %d\n",
+				describeDevice(function.Device),
+				driver,
+				groupLabel(),
+				function.Group,
+			))
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,136 @@
+package iommu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Reads an attribute of a PCI device from sysfs, returns an empty string if the attribute can not be read
+func readDeviceAttr(address string, attr string) string {
+	content, err := os.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/%s", address, attr))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(content))
+}
+
+// Writes an attribute of a PCI device in sysfs
+func writeDeviceAttr(address string, attr string, value string) error {
+	file := fmt.Sprintf("/sys/bus/pci/devices/%s/%s", address, attr)
+	if err := os.WriteFile(file, []byte(value), 0200); err != nil {
+		return fmt.Errorf("unable to write %q to %s (run ls-iommu as root): %v", value, file, err)
+	}
+
+	return nil
+}
+
+// Reads a whole file, returns an empty string if it can not be read
+func readFile(file string) string {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+
+	return string(content)
+}
+
+// Gets the NUMA node of a PCI device, returns -1 if the system is not NUMA or the node is unknown
+func getNUMANode(address string) int {
+	node, err := strconv.Atoi(readDeviceAttr(address, "numa_node"))
+	if err != nil {
+		return -1
+	}
+
+	return node
+}
+
+// Gets the current PCIe link speed of a device in GT/s, returns 0 if the device has no PCIe link
+func getLinkSpeed(address string) float64 {
+	// The link speed is in the form "8.0 GT/s PCIe" (or just "8 GT/s" on older kernels)
+	fields := strings.Fields(readDeviceAttr(address, "current_link_speed"))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	speed, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+
+	return speed
+}
+
+// Regex to match a full PCI address (ex: 0000:01:00.0)
+var pciAddressRegex = regexp.MustCompile(`^[0-9a-f]{4,}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// Adds the default PCI domain to short PCI addresses (ex: 01:00.0 becomes 0000:01:00.0)
+func normalizeAddress(address string) string {
+	address = strings.ToLower(address)
+	if strings.Count(address, ":") == 1 {
+		return fmt.Sprintf("0000:%s", address)
+	}
+
+	return address
+}
+
+// Gets the PCI addresses of the bridges above a device, starting with the one closest to the root complex
+func getParentBridges(address string) []string {
+	var bridges []string
+
+	// The sysfs path of the device contains every bridge between the root complex and the device
+	path, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/bus/pci/devices/%s", address))
+	if err != nil {
+		return bridges
+	}
+
+	for _, part := range strings.Split(filepath.Dir(path), "/") {
+		if pciAddressRegex.MatchString(part) {
+			bridges = append(bridges, part)
+		}
+	}
+
+	return bridges
+}
+
+// Gets the slot of a PCI address by removing the function (ex: 0000:01:00.1 becomes 0000:01:00)
+func slotAddress(address string) string {
+	if i := strings.LastIndex(address, "."); i >= 0 {
+		return address[:i]
+	}
+
+	return address
+}
+
+// Gets the upstream port of the PCIe switch a device is directly below, returns an empty string if the device
+// is not below a switch. If the port types can not be read (needs root) any bridge that is not a root port counts
+func getSwitchUpstreamPort(address string) string {
+	// A switch needs at least an upstream and a downstream port above the device (the root port can be missing)
+	bridges := getParentBridges(address)
+	if len(bridges) < 2 {
+		return ""
+	}
+	downstream := bridges[len(bridges)-1]
+	upstream := bridges[len(bridges)-2]
+
+	// If we can read the port types, use them
+	downstreamType := getPCIeType(downstream)
+	upstreamType := getPCIeType(upstream)
+	if downstreamType >= 0 && upstreamType >= 0 {
+		if downstreamType == pcieTypeDownstream && upstreamType == pcieTypeUpstream {
+			return upstream
+		}
+		return ""
+	}
+
+	// Else we assume it is a switch port if it is not on the root bus, a root port can not be the upstream port of a switch
+	if len(getParentBridges(upstream)) > 0 {
+		return upstream
+	}
+
+	return ""
+}
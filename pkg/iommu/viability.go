@@ -0,0 +1,150 @@
+package iommu
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/HikariKnight/ls-iommu/pkg/params"
+)
+
+/*
+	VFIO only lets a VM open /dev/vfio/N when the IOMMU group is viable,
+	which means every device in the group that is not a bridge is either bound
+	to a driver that is safe for VFIO or not bound to a driver at all
+*/
+
+// The drivers a device in a viable group can be bound to
+var viableDrivers = []string{"vfio-pci", "pci-stub"}
+
+// Exit code for the viable command when a group is not viable
+const ExitNotViable = 5
+
+// A device that keeps an IOMMU group from being viable and the driver it is bound to
+type Blocker struct {
+	Address string
+	Driver  string
+}
+
+// The viability of an IOMMU group
+type GroupViability struct {
+	Group    *Group
+	Blockers []Blocker
+}
+
+// Checks if the group is viable right now
+func (v *GroupViability) Viable() bool {
+	return len(v.Blockers) == 0
+}
+
+// Gets the devices in an IOMMU group that keep it from being viable, based on the current driver bindings
+func getGroupBlockers(id int) []Blocker {
+	var blockers []Blocker
+
+	devices, _ := filepath.Glob(fmt.Sprintf("/sys/kernel/iommu_groups/%d/devices/*", id))
+	sort.Strings(devices)
+	for _, device := range devices {
+		address := filepath.Base(device)
+
+		// Bridges do not count
+		if isBridgeAddress(address) {
+			continue
+		}
+
+		// Devices without a driver do not count either
+		driver, err := filepath.EvalSymlinks(filepath.Join(device, "driver"))
+		if err != nil {
+			continue
+		}
+
+		if !isViableDriver(filepath.Base(driver)) {
+			blockers = append(blockers, Blocker{Address: address, Driver: filepath.Base(driver)})
+		}
+	}
+
+	return blockers
+}
+
+// Generates the viability column for the device line (-F viable)
+func viabilityColumn(group int) string {
+	// Predicted groups do not exist, so there is nothing VFIO could use
+	if predictedGroups {
+		return "[predicted]"
+	}
+
+	if len(getGroupBlockers(group)) > 0 {
+		return "[not viable]"
+	}
+
+	return "[viable]"
+}
+
+// Checks if a driver is safe to have in a viable group
+func isViableDriver(driver string) bool {
+	for _, viable := range viableDrivers {
+		if driver == viable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if the IOMMU groups given as a PCI address, group number, with -i or the selectors are viable,
+// every group is checked if nothing is given
+func CheckViability(target string, pArg *params.Params) ([]*GroupViability, error) {
+	var viability []*GroupViability
+
+	alldevs, targets, err := resolveTargets(target, pArg)
+	if err != nil {
+		return viability, err
+	}
+
+	// Predicted groups can not be used by VFIO
+	if alldevs.Predicted {
+		return viability, fmt.Errorf("the IOMMU is disabled, no group can be used by VFIO until it is enabled")
+	}
+
+	for _, id := range sortedGroupIDs(targets) {
+		viability = append(viability, &GroupViability{
+			Group:    alldevs.Groups[id],
+			Blockers: getGroupBlockers(id),
+		})
+	}
+
+	return viability, nil
+}
+
+// Generates the report for the groups checked for viability
+func GenViabilityReport(viability []*GroupViability) []string {
+	var lines []string
+
+	for _, group := range viability {
+		if group.Viable() {
+			lines = append(lines, fmt.Sprintf("IOMMU Group %d: viable\n", group.Group.ID))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("IOMMU Group %d: not viable, blocked by:\n", group.Group.ID))
+		for _, blocker := range group.Blockers {
+			name := blocker.Address
+			if device, exists := group.Group.Devices[blocker.Address]; exists {
+				name = describeDevice(device)
+			}
+			lines = append(lines, fmt.Sprintf("\t%s (bound to %s)\n", name, blocker.Driver))
+		}
+	}
+
+	return lines
+}
+
+// Returns the exit code for the viable command, 0 if every group is viable
+func ViabilityExitCode(viability []*GroupViability) int {
+	for _, group := range viability {
+		if !group.Viable() {
+			return ExitNotViable
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,60 @@
+package params
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Reads lists from the config files so arguments can be set permanently
+
+	Each list is a plain text file with one entry per line, empty lines
+	and lines starting with # are ignored. The files are read from
+	/etc/ls-iommu/<name> and $XDG_CONFIG_HOME/ls-iommu/<name>
+	(~/.config/ls-iommu/<name> if XDG_CONFIG_HOME is not set)
+*/
+
+// Returns all the config directories we read from, in the order they are read
+func configDirs() []string {
+	dirs := []string{"/etc/ls-iommu"}
+
+	// Use XDG_CONFIG_HOME if set, else fall back to ~/.config
+	if configHome, exists := os.LookupEnv("XDG_CONFIG_HOME"); exists && configHome != "" {
+		dirs = append(dirs, filepath.Join(configHome, "ls-iommu"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", "ls-iommu"))
+	}
+
+	return dirs
+}
+
+// Reads the list with the given name from every config directory and returns all the entries
+func readConfigList(name string) []string {
+	var entries []string
+
+	for _, dir := range configDirs() {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			// A missing config file is not an error, it just means there is nothing to read
+			continue
+		}
+
+		// Read the file line by line
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			// Skip empty lines and comments
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			entries = append(entries, line)
+		}
+		file.Close()
+	}
+
+	return entries
+}
@@ -3,6 +3,8 @@ package params
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/akamensky/argparse"
 )
@@ -21,12 +23,25 @@ type Params struct {
 	IntList     map[string][]int
 	StringList  map[string][]string
 	String      map[string]string
+
+	// The names of the device selector flags that were given
+	selectors []string
+	// How many excludes were given as arguments, the ones from the config files are not checked by validate
+	excludeArgs int
 }
 
 func (p *Params) addFlag(name string, flag bool) {
 	p.Flag[name] = flag
 }
 
+// Adds a device selector flag, selectors are flags like -g that pick which devices to list
+func (p *Params) addSelector(name string, flag bool) {
+	p.addFlag(name, flag)
+	if flag {
+		p.selectors = append(p.selectors, name)
+	}
+}
+
 func (p *Params) addFlagCounter(name string, flag int) {
 	p.FlagCounter[name] = flag
 }
@@ -43,9 +58,106 @@ func (p *Params) addString(name string, flag string) {
 	p.String[name] = flag
 }
 
+// The default format of the device lines
+const defaultFormat = "pciaddr,subclass_name,subclass_id,name,device_id,optional_revision,boot_vga"
+
+// Regex to check if an argument is a PCI address, the domain is optional (ex: 0000:01:00.0 or 01:00.0)
+var pciAddressRegex = regexp.MustCompile(`^([0-9a-f]{4,}:)?[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// A command that can be given as the first argument (ex: ls-iommu find <text>)
+type command struct {
+	Name string
+	// The argument the command takes, shown in the help text
+	Target string
+	// If the command can not run without its argument
+	TargetRequired bool
+	Help           string
+}
+
+// All commands, the flags work with every command unless the help text says otherwise
+var commands = []command{
+	{
+		Name:           "find",
+		Target:         "<text>",
+		TargetRequired: true,
+		Help:           "Search for devices by vendor, product, subsystem or OEM name, best matches first",
+	},
+	{
+		Name:   "check",
+		Target: "[<pci address>|<group>]",
+		Help: "Check if a device, IOMMU group, the groups given with -i or the selected devices (ex: -g) can be passed through on their own. " +
+			"Exits with 0 if isolated, 2 if the group is shared with functions of the same slot only and 3 if it is shared with unrelated devices",
+	},
+	{
+		Name:   "viable",
+		Target: "[<pci address>|<group>]",
+		Help: "Check if the IOMMU groups can be used by VFIO right now, which needs every device that is not a bridge to be bound to vfio-pci, pci-stub or no driver. " +
+			"Checks every group unless a device, group, -i or device selectors are given. Exits with 0 if every group is viable and 5 if not",
+	},
+	{
+		Name:           "explain",
+		Target:         "<group>",
+		TargetRequired: true,
+		Help:           "Explain why the devices in an IOMMU group share it, by showing the ACS state of every bridge above them (needs root)",
+	},
+	{
+		Name:   "simulate",
+		Target: "[<override>]",
+		Help: "Predict the IOMMU groups with pcie_acs_override (ex: downstream,multifunction or id:8086:1901) and show them side by side with the current groups. " +
+			"Simulates the common variants if none is given (needs root)",
+	},
+	{
+		Name: "slots",
+		Help: "List the physical slots and root ports, the devices behind them and if they use CPU or chipset lanes. " +
+			"Use --recommend to see which slots give a card its own IOMMU group",
+	},
+	{
+		Name:           "reset",
+		Target:         "<pci address>",
+		TargetRequired: true,
+		Help: "Reset a device through sysfs and check that it responds afterwards (needs root). " +
+			"Refuses devices bound to a driver other than vfio-pci unless --force is given, and bus resets that would reset other devices",
+	},
+}
+
+// Splits the command and its argument from the rest of the arguments, commands must be the first argument
+func splitCommand(args []string) (*command, string, []string) {
+	// If the first argument is not a known command, there is no command
+	if len(args) < 2 {
+		return nil, "", args
+	}
+	for i := range commands {
+		if commands[i].Name == args[1] {
+			rest := append([]string{args[0]}, args[2:]...)
+
+			// The argument for the command is the next argument if it is not a flag
+			if len(rest) > 1 && !strings.HasPrefix(rest[1], "-") {
+				return &commands[i], rest[1], append([]string{rest[0]}, rest[2:]...)
+			}
+			return &commands[i], "", rest
+		}
+	}
+
+	return nil, "", args
+}
+
+// Generates the description shown at the top of the help text, including the commands
+func description() string {
+	lines := []string{"A Tool to print out all devices and their IOMMU groups", "", "Commands:"}
+	for _, cmd := range commands {
+		name := cmd.Name
+		if cmd.Target != "" {
+			name = fmt.Sprintf("%s %s", cmd.Name, cmd.Target)
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s", name, cmd.Help))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
 func NewParams() *Params {
 	// Setup the parser for arguments
-	parser := argparse.NewParser("ls-iommu", "A Tool to print out all devices and their IOMMU groups")
+	parser := argparse.NewParser("ls-iommu", description())
 
 	// Add version flag
 	version := parser.Flag("v", "version", &argparse.Options{
@@ -84,6 +196,66 @@ func NewParams() *Params {
 		Help:     "List all Audio devices. (use -i # to only display results from specified IOMMU group)",
 	})
 
+	class := parser.StringList("c", "class", &argparse.Options{
+		Required: false,
+		Help:     "List all devices matching a PCI class code (ex: 0c03, 0108, 0c0330) or class name (ex: \"Processing accelerators\"). Supply argument multiple times to list additional classes. (use -i # to only display results from specified IOMMU group)",
+	})
+
+	listclasses := parser.Flag("", "list-classes", &argparse.Options{
+		Required: false,
+		Help:     "List every device class present on this system and how many devices belong to it",
+	})
+
+	vendor := parser.StringList("", "vendor", &argparse.Options{
+		Required: false,
+		Help:     "Only list devices with the given Vendor ID, wildcards (* and ?) are supported. Supply argument multiple times to allow additional vendors. (works with every mode)",
+	})
+
+	device := parser.StringList("", "device", &argparse.Options{
+		Required: false,
+		Help:     "Only list devices matching the given ID in the form vendor[:device[:subvendor[:subdevice]]] (ex: 1002:73bf or 10de:*), wildcards (* and ?) are supported. Supply argument multiple times to allow additional devices. (works with every mode)\n\t\t Given a PCI Address instead (ex: 0000:01:00.0 or 01:00.0) it prints everything known about that device",
+	})
+
+	driver := parser.StringList("", "driver", &argparse.Options{
+		Required: false,
+		Help:     "Only list devices bound to the given kernel driver (ex: vfio-pci), wildcards (* and ?) are supported. Supply argument multiple times to allow additional drivers. (works with every mode)",
+	})
+
+	nodriver := parser.Flag("", "no-driver", &argparse.Options{
+		Required: false,
+		Help:     "Only list devices that are not bound to any kernel driver, can be combined with --driver. (works with every mode)",
+	})
+
+	notdriver := parser.StringList("", "not-driver", &argparse.Options{
+		Required: false,
+		Help:     "Leave out devices bound to the given kernel driver, wildcards (* and ?) are supported. Supply argument multiple times to leave out additional drivers. (works with every mode)",
+	})
+
+	exclude := parser.StringList("x", "exclude", &argparse.Options{
+		Required: false,
+		Help:     "Leave out devices matching a PCI Address (ex: 00:1f.3), VendorID:DeviceID (ex: 8086:a3a3), class code or class name (ex: 0c05), or \"bridge\" for all bridges. Supply argument multiple times to leave out more devices. (works with every mode)\n\t\t Entries can also be put one per line in /etc/ls-iommu/exclude or ~/.config/ls-iommu/exclude",
+	})
+
+	noconfig := parser.Flag("", "no-config", &argparse.Options{
+		Required: false,
+		Help:     "Ignore the config files in /etc/ls-iommu and ~/.config/ls-iommu",
+	})
+
+	whereexpr := parser.String("", "where", &argparse.Options{
+		Required: false,
+		Help:     "Only list devices matching an expression (ex: 'class==\"VGA\" && driver!=\"vfio-pci\" && numa==1'). (works with every mode)\n\t\t Fields: group, address, class, vendor_id, device_id, driver, numa, isolated, viable, link_speed, boot_vga\n\t\t Operators: == != < <= > >= && || ! and parentheses",
+	})
+
+	of := parser.StringList("", "of", &argparse.Options{
+		Required: false,
+		Help:     "List the IOMMU group entry of the PCI device behind a device node, interface or device name (ex: eth0, /dev/nvme1n1, /dev/dri/card1, card2, /dev/hidraw0, 1-2). Supply argument multiple times to look up more devices.",
+	})
+
+	bridges := parser.Selector("", "bridges", []string{"show", "hide", "only"}, &argparse.Options{
+		Required: false,
+		Help:     "Show, hide or only show bridges (devices with class 06 or a bridge header) in every mode. By default bridges are listed, but left out of --id and --pciaddr output",
+	})
+
 	iommu_group := parser.IntList("i", "group", &argparse.Options{
 		Required: false,
 		Help:     "List everything in the IOMMU groups given. Supply argument multiple times to list additional groups.",
@@ -91,20 +263,30 @@ func NewParams() *Params {
 
 	related := parser.FlagCounter("r", "related", &argparse.Options{
 		Required: false,
-		Help:     "Attempt to list related devices that share IOMMU Groups or\n\t\t Vendor ID (used with -g -u -i -s and -n), pass -rr if you want to search using both when used with -g -i -s or -n\n\t\t Note: -rr can be inaccurate or too broad when many devices share Vendor ID",
+		Help:     "List related devices found through the PCI topology: other functions in the same slot, devices in the same IOMMU group and devices below the same PCIe switch.\n\t\t Each related device is labelled with why it was included (works with every selector and -i), pass -rr to also include devices sharing Vendor ID\n\t\t Note: -rr can be inaccurate or too broad when many devices share Vendor ID",
 	})
 
 	ignore := parser.StringList("R", "ignore", &argparse.Options{
 		Required: false,
-		Help:     "Ignores passed VendorID (Left part of : in [VendorID:DeviceID]) outside of the selected IOMMU group when doing a --related search, you can use this to ignore unreliable Vendor IDs when doing related searches. (works with -g -i -u -s and -n)",
+		Help:     "Ignores passed VendorID (Left part of : in [VendorID:DeviceID]) outside of the selected IOMMU group when doing a --related search, you can use this to ignore unreliable Vendor IDs when doing related searches. (works with every selector and -i)",
 	})
 
 	kernelmodules := parser.Flag("k", "kernel", &argparse.Options{
 		Required: false,
-		Help:     "Lists subsystems and kernel drivers using the devices.",
+		Help:     "Lists subsystems and kernel drivers using the devices, and how the devices can be reset and known issues with them (FLR, bus and power management resets need root to be shown).",
 		Default:  false,
 	})
 
+	byslot := parser.Flag("", "by-slot", &argparse.Options{
+		Required: false,
+		Help:     "List the selected devices by slot, with every function in the slot and its class, driver and IOMMU group. Slots with functions split across IOMMU groups are flagged (works with every selector, -i and filters)",
+	})
+
+	recommend := parser.Flag("", "recommend", &argparse.Options{
+		Required: false,
+		Help:     "Show if the devices behind each slot get their own IOMMU group and which empty slots would give a card its own group (only works with the slots command)",
+	})
+
 	legacyoutput := parser.Flag("", "legacy", &argparse.Options{
 		Required: false,
 		Help:     "Generate the output unsorted and be the same output as the old bash script",
@@ -113,27 +295,45 @@ func NewParams() *Params {
 
 	id := parser.Flag("", "id", &argparse.Options{
 		Required: false,
-		Help:     "Print out only VendorID:DeviceID for non bridge devices (Only works with -i)",
+		Help:     "Print out only VendorID:DeviceID for non bridge devices (works with every selector, -i, --related and the default listing), warns if the IDs also belong to devices that were not selected",
 	})
 
 	pciaddr := parser.Flag("", "pciaddr", &argparse.Options{
 		Required: false,
-		Help:     "Print out only the PCI Address for non bridge devices (Only works with -i)",
+		Help:     "Print out only the PCI Address for non bridge devices (works with every selector, -i, --related and the default listing)",
 	})
 
 	rom := parser.Flag("", "rom", &argparse.Options{
 		Required: false,
-		Help:     "Print out the rom path GPUs. (must be used with -g or --gpu)",
+		Help:     "Print out the rom path of the devices that have one, like GPUs (works with every selector, -i, --related and the default listing)",
+	})
+
+	resetmethod := parser.Selector("", "method", []string{"flr", "bus", "pm"}, &argparse.Options{
+		Required: false,
+		Help:     "The method to reset the device with, the kernel picks one if not given (only works with the reset command)",
+	})
+
+	force := parser.Flag("", "force", &argparse.Options{
+		Required: false,
+		Help:     "Reset the device even if it is bound to a driver other than vfio-pci (only works with the reset command)",
+	})
+
+	jsonoutput := parser.Flag("", "json", &argparse.Options{
+		Required: false,
+		Help:     "Print the devices as a JSON array with every field we know about them, including how they can be reset (works with every selector, -i, --related, find, --of and the default listing)",
 	})
 
 	format := parser.String("F", "format", &argparse.Options{
 		Required: false,
-		Help:     "Formats the device line output the way you want it (omit what you do not want)\n\t\t Supported objects: pciaddr, subclass_name, subclass_name:, subclass_id, subclass_id:, name, name:, device_id, device_id:, vendor, vendor:, oem, oem:, prod_name, prod_name:, revision, optional_revision",
-		Default:  "pciaddr,subclass_name,subclass_id,name,device_id,optional_revision",
+		Help:     "Formats the device line output the way you want it (omit what you do not want)\n\t\t Supported objects: pciaddr, subclass_name, subclass_name:, subclass_id, subclass_id:, name, name:, device_id, device_id:, vendor, vendor:, oem, oem:, prod_name, prod_name:, revision, optional_revision, viable, viable:, boot_vga, boot_vga:",
+		Default:  defaultFormat,
 	})
 
+	// Take out the command (if any) before parsing the arguments
+	cmd, target, args := splitCommand(os.Args)
+
 	// Parse arguments
-	err := parser.Parse(os.Args)
+	err := parser.Parse(args)
 	if err != nil {
 		// In case of error print error and print usage
 		// This can also be done by passing -h or --help flags
@@ -141,6 +341,12 @@ func NewParams() *Params {
 		os.Exit(4)
 	}
 
+	// Make sure the command got its argument if it needs one
+	if cmd != nil && cmd.TargetRequired && target == "" {
+		fmt.Print(parser.Usage(fmt.Errorf("%s requires %s", cmd.Name, cmd.Target)))
+		os.Exit(4)
+	}
+
 	// Make our struct
 	pArg := &Params{
 		Flag:        make(map[string]bool),
@@ -154,21 +360,223 @@ func NewParams() *Params {
 	pArg.addFlag("version", *version)
 
 	// Add all parsed arguments to a struct for portability since we will use them all over the program
-	pArg.addFlag("gpu", *gpu)
-	pArg.addFlag("usb", *usb)
-	pArg.addFlag("nic", *nic)
-	pArg.addFlag("sata", *sata)
-	pArg.addFlag("nvme", *nvme)
-	pArg.addFlag("audio", *audio)
+	pArg.addSelector("gpu", *gpu)
+	pArg.addSelector("usb", *usb)
+	pArg.addSelector("nic", *nic)
+	pArg.addSelector("sata", *sata)
+	pArg.addSelector("nvme", *nvme)
+	pArg.addSelector("audio", *audio)
+	pArg.addStringList("class", *class)
+	pArg.addFlag("listclasses", *listclasses)
+	pArg.addStringList("vendor", *vendor)
+	// PCI addresses given to --device are device lookups, everything else is an ID filter
+	var deviceids, deviceaddrs []string
+	for _, value := range *device {
+		if pciAddressRegex.MatchString(strings.ToLower(value)) {
+			deviceaddrs = append(deviceaddrs, value)
+		} else {
+			deviceids = append(deviceids, value)
+		}
+	}
+	pArg.addStringList("device", deviceids)
+	pArg.addStringList("deviceaddr", deviceaddrs)
+	pArg.addStringList("of", *of)
+	pArg.addStringList("driver", *driver)
+	pArg.addFlag("nodriver", *nodriver)
+	pArg.addStringList("notdriver", *notdriver)
+	pArg.addString("where", *whereexpr)
+	pArg.addString("bridges", *bridges)
+	pArg.addFlag("noconfig", *noconfig)
 	pArg.addFlagCounter("related", *related)
 	pArg.addStringList("ignore", *ignore)
 	pArg.addIntList("iommu_group", *iommu_group)
 	pArg.addFlag("kernelmodules", *kernelmodules)
+	pArg.addFlag("byslot", *byslot)
+	pArg.addFlag("recommend", *recommend)
 	pArg.addFlag("legacyoutput", *legacyoutput)
 	pArg.addFlag("id", *id)
 	pArg.addFlag("pciaddr", *pciaddr)
 	pArg.addFlag("rom", *rom)
+	pArg.addFlag("json", *jsonoutput)
+	pArg.addString("method", *resetmethod)
+	pArg.addFlag("force", *force)
 	pArg.addString("format", *format)
 
+	// Add the command and its argument
+	if cmd != nil {
+		pArg.addString("command", cmd.Name)
+		pArg.addString("target", target)
+	}
+
+	// Add the excludes from the config files to the excludes given as arguments
+	pArg.excludeArgs = len(*exclude)
+	if !*noconfig {
+		*exclude = append(*exclude, readConfigList("exclude")...)
+	}
+	pArg.addStringList("exclude", *exclude)
+
+	// Make sure the arguments given make sense together
+	err = pArg.validate()
+	if err != nil {
+		fmt.Print(parser.Usage(err))
+		os.Exit(4)
+	}
+
 	return pArg
 }
+
+// Checks that the arguments given can be used together, returns an error for the first combination that makes no sense
+func (p *Params) validate() error {
+	// Which of the arguments we care about were given
+	given := map[string]bool{
+		"--id":                   p.Flag["id"],
+		"--pciaddr":              p.Flag["pciaddr"],
+		"--rom":                  p.Flag["rom"],
+		"--json":                 p.Flag["json"],
+		"-k":                     p.Flag["kernelmodules"],
+		"-F":                     p.String["format"] != defaultFormat,
+		"--legacy":               p.Flag["legacyoutput"],
+		"-r":                     p.FlagCounter["related"] > 0,
+		"-R":                     len(p.StringList["ignore"]) > 0,
+		"-i":                     len(p.IntList["iommu_group"]) > 0,
+		"selectors":              len(p.selectors) > 0 || len(p.StringList["class"]) > 0,
+		"--list-classes":         p.Flag["listclasses"],
+		"--by-slot":              p.Flag["byslot"],
+		"--device <pci address>": len(p.StringList["deviceaddr"]) > 0,
+		"--of":                   len(p.StringList["of"]) > 0,
+		"--vendor":               len(p.StringList["vendor"]) > 0,
+		"--device <id>":          len(p.StringList["device"]) > 0,
+		"--driver":               len(p.StringList["driver"]) > 0,
+		"--no-driver":            p.Flag["nodriver"],
+		"--not-driver":           len(p.StringList["notdriver"]) > 0,
+		"--exclude":              p.excludeArgs > 0,
+		"--where":                p.String["where"] != "",
+		"--bridges":              p.String["bridges"] != "",
+	}
+	if p.String["command"] != "" {
+		given[p.String["command"]] = true
+	}
+
+	// Checks if an argument from each list was given, and returns an error naming them if so
+	conflict := func(a []string, b []string) error {
+		for _, first := range a {
+			for _, second := range b {
+				if first != second && given[first] && given[second] {
+					return fmt.Errorf("%s can not be used together with %s", first, second)
+				}
+			}
+		}
+		return nil
+	}
+
+	// The modes that replace the device listing
+	modes := []string{"--list-classes", "--by-slot", "--device <pci address>", "--of", "find", "check", "viable", "explain", "simulate", "slots", "reset"}
+
+	// The output modifiers that replace the device line
+	modifiers := []string{"--id", "--pciaddr", "--rom", "--json"}
+
+	// The filters that narrow down the devices listed
+	filters := []string{"--vendor", "--device <id>", "--driver", "--no-driver", "--not-driver", "--exclude", "--where", "--bridges"}
+
+	// The order of the checks decides which error the user gets first
+	checks := []error{
+		// Only one mode and one output modifier at a time
+		conflict(modes, modes),
+		conflict(modifiers, modifiers),
+		// The output modifiers replace the whole device line, so the line formatting does nothing
+		conflict(modifiers, []string{"-k", "-F", "--legacy"}),
+		// These modes have their own output
+		conflict(modifiers, []string{"--list-classes", "--by-slot", "--device <pci address>", "check", "viable", "explain", "simulate", "slots", "reset"}),
+		// These modes do not list selected devices
+		conflict([]string{"-i", "-r"}, []string{"--list-classes", "--device <pci address>", "--of", "find", "explain", "slots", "reset"}),
+		conflict([]string{"-r"}, []string{"--by-slot", "check", "viable", "simulate"}),
+		// These modes do not use the device line
+		conflict([]string{"-k", "-F", "--legacy"}, []string{"--list-classes", "--by-slot", "check", "viable", "explain", "simulate", "slots", "reset"}),
+		// --device always shows the kernel driver info
+		conflict([]string{"-k"}, []string{"--device <pci address>"}),
+		// These modes work on a single device or group, or on every slot, so there is nothing to filter
+		conflict(filters, []string{"--device <pci address>", "explain", "slots", "reset"}),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+
+	// The selectors are named by the flags the user gave, --by-slot works with them
+	if given["selectors"] {
+		for _, mode := range modes {
+			if given[mode] && mode != "--by-slot" && mode != "check" && mode != "viable" && mode != "simulate" {
+				return fmt.Errorf("device selectors (%s) can not be used together with %s", strings.Join(p.selectorNames(), ", "), mode)
+			}
+		}
+	}
+
+	// check and viable work on a device or group from their argument, or on the groups from -i and the selectors
+	if given["check"] || given["viable"] {
+		cmd, target := p.String["command"], p.String["target"]
+		switch {
+		case target != "" && (given["selectors"] || given["-i"]):
+			return fmt.Errorf("%s takes either a PCI address or group, or -i and the device selectors, not both", cmd)
+		case target != "" && !pciAddressRegex.MatchString(strings.ToLower(target)) && !isNumber(target):
+			return fmt.Errorf("%s requires a PCI address (ex: 01:00.0) or an IOMMU group number, got %q", cmd, target)
+		case cmd == "check" && target == "" && !given["selectors"] && !given["-i"]:
+			// check has nothing to compare against without a target
+			return fmt.Errorf("check requires a PCI address, an IOMMU group, -i or a device selector (ex: -g)")
+		}
+	}
+
+	// --recommend is part of the slots command
+	if p.Flag["recommend"] && !given["slots"] {
+		return fmt.Errorf("--recommend only works with the slots command")
+	}
+
+	// --method and --force are part of the reset command, which needs a PCI address
+	if (p.String["method"] != "" || p.Flag["force"]) && !given["reset"] {
+		return fmt.Errorf("--method and --force only work with the reset command")
+	}
+	if given["reset"] && !pciAddressRegex.MatchString(strings.ToLower(p.String["target"])) {
+		return fmt.Errorf("reset requires a PCI address (ex: 01:00.0), got %q", p.String["target"])
+	}
+
+	// explain works on a single group
+	if given["explain"] && !isNumber(p.String["target"]) {
+		return fmt.Errorf("explain requires an IOMMU group number, got %q", p.String["target"])
+	}
+
+	// -R only does something during a related search
+	if given["-R"] && !given["-r"] {
+		return fmt.Errorf("-R/--ignore only works together with -r/--related")
+	}
+
+	// There is no -rrr
+	if p.FlagCounter["related"] > 2 {
+		return fmt.Errorf("-r/--related can be given at most twice (-rr)")
+	}
+
+	return nil
+}
+
+// Checks if a string only contains digits
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the selector flags given, including --class
+func (p *Params) selectorNames() []string {
+	names := append([]string{}, p.selectors...)
+	if len(p.StringList["class"]) > 0 {
+		names = append(names, "class")
+	}
+
+	return names
+}
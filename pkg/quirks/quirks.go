@@ -0,0 +1,111 @@
+package quirks
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+
+	"github.com/HikariKnight/ls-iommu/pkg/errorcheck"
+)
+
+/*
+	A table of known device specific problems with passthrough and how to work around them
+
+	The table is embedded from quirks.json, bump the version in it when changing it.
+	Find the quirks that may apply to a device from its IDs
+	matches := quirks.Match("1002", "67df", "030000", "1da2", "e366")
+
+	Every quirk matches on:
+		vendor                                  (required)
+		devices                                 (any device of the vendor if empty)
+		class                                   (prefix of the class code, ex: 0300)
+		subsystem_vendor, subsystem_devices     (any subsystem if empty)
+	A quirk can also have a condition the caller has to check against the topology:
+		root_bus            the device is on the root bus (ex: integrated GPUs)
+		no_other_functions  the device is the only function in its slot
+	A quirk can name a kernel module that works around the problem (ex: vendor_reset).
+	Quirks that only might apply to the device are marked as a hint
+*/
+
+//go:embed quirks.json
+var tableJSON []byte
+
+// A known problem with a device and how to work around it
+type Quirk struct {
+	ID               string   `json:"id"`
+	Vendor           string   `json:"vendor"`
+	Devices          []string `json:"devices,omitempty"`
+	Class            string   `json:"class,omitempty"`
+	SubsystemVendor  string   `json:"subsystem_vendor,omitempty"`
+	SubsystemDevices []string `json:"subsystem_devices,omitempty"`
+	Condition        string   `json:"condition,omitempty"`
+	Hint             bool     `json:"hint,omitempty"`
+	Summary          string   `json:"summary"`
+	Mitigation       string   `json:"mitigation"`
+	Module           string   `json:"module,omitempty"`
+}
+
+// The quirk table and its version
+type Table struct {
+	Version int     `json:"version"`
+	Quirks  []Quirk `json:"quirks"`
+}
+
+// The embedded table, parsed the first time it is used
+var table *Table
+
+// Gets the embedded quirk table
+func GetTable() *Table {
+	if table == nil {
+		table = &Table{}
+		err := json.Unmarshal(tableJSON, table)
+		errorcheck.ErrorCheck(err, "Failed to parse the embedded quirk table")
+	}
+
+	return table
+}
+
+// Returns the version of the embedded quirk table
+func Version() int {
+	return GetTable().Version
+}
+
+// Gets the quirks matching the IDs and class code of a device, the conditions of the quirks are not checked
+func Match(vendor string, device string, class string, subVendor string, subDevice string) []*Quirk {
+	var matches []*Quirk
+
+	for i, quirk := range GetTable().Quirks {
+		if !strings.EqualFold(quirk.Vendor, vendor) ||
+			!matchesAny(quirk.Devices, device) ||
+			!strings.HasPrefix(strings.ToLower(class), strings.ToLower(quirk.Class)) {
+			continue
+		}
+
+		// The subsystem narrows a quirk down to specific cards
+		if quirk.SubsystemVendor != "" && !strings.EqualFold(quirk.SubsystemVendor, subVendor) {
+			continue
+		}
+		if !matchesAny(quirk.SubsystemDevices, subDevice) {
+			continue
+		}
+
+		matches = append(matches, &GetTable().Quirks[i])
+	}
+
+	return matches
+}
+
+// Checks if an ID is in a list of IDs, an empty list matches every ID
+func matchesAny(ids []string, id string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+
+	for _, other := range ids {
+		if strings.EqualFold(other, id) {
+			return true
+		}
+	}
+
+	return false
+}
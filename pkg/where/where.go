@@ -0,0 +1,442 @@
+package where
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	A small typed expression language used to filter devices
+
+	Parse an expression where every field has a known kind
+	expr, err := where.Parse(`class=="VGA" && driver!="vfio-pci"`, kinds)
+
+	Then evaluate it against the values of a record
+	match := expr.Eval(values)
+
+	Supported syntax:
+		field == value, field != value   (every kind)
+		field < value, <=, >, >=         (numbers only)
+		field                            (booleans only)
+		!expr, expr && expr, expr || expr, (expr)
+	Values are "strings" or 'strings', numbers, true or false
+*/
+
+// The kind of value a field holds
+type Kind int
+
+const (
+	// Field values are strings
+	String Kind = iota
+	// Field values are float64
+	Number
+	// Field values are bool
+	Bool
+	// Field values are func(string) bool, == and != call the function with the value to match
+	Match
+)
+
+// Returns the name of the kind for use in error messages
+func (k Kind) String() string {
+	switch k {
+	case Number:
+		return "number"
+	case Bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// A parse error with the column in the expression where it happened
+type Error struct {
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+// A parsed expression that can be evaluated against the values of a record
+type Expr struct {
+	root node
+}
+
+// Evaluates the expression against the values of a record, every field in kinds must have a value
+func (e *Expr) Eval(values map[string]interface{}) bool {
+	return e.root.eval(values)
+}
+
+// Parses an expression, kinds holds every field that can be used and the kind of value it holds
+func Parse(input string, kinds map[string]Kind) (*Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, kinds: kinds}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything should have been consumed by now
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+
+	return &Expr{root: root}, nil
+}
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// Describes the token for use in error messages
+func (t token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("string %q", t.val)
+	default:
+		return fmt.Sprintf("%q", t.val)
+	}
+}
+
+// Splits the input into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			typ := tokLParen
+			if r == ')' {
+				typ = tokRParen
+			}
+			tokens = append(tokens, token{typ: typ, val: string(r), pos: i})
+			i++
+
+		case r == '"' || r == '\'':
+			// Read until the matching quote, a backslash escapes the next character
+			var value strings.Builder
+			start := i
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &Error{Column: start + 1, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{typ: tokString, val: value.String(), pos: start})
+			i++
+
+		case unicode.IsDigit(r) || r == '.' || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokNumber, val: string(runes[start:i]), pos: start})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokIdent, val: string(runes[start:i]), pos: start})
+
+		default:
+			// Try the two character operators before the single character ones
+			op := ""
+			if i+1 < len(runes) {
+				switch string(runes[i : i+2]) {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = string(runes[i : i+2])
+				}
+			}
+			if op == "" {
+				switch r {
+				case '<', '>', '!':
+					op = string(r)
+				case '=':
+					return nil, &Error{Column: i + 1, Msg: `unexpected "=", use "==" to compare`}
+				default:
+					return nil, &Error{Column: i + 1, Msg: fmt.Sprintf("unexpected character %q", r)}
+				}
+			}
+			tokens = append(tokens, token{typ: tokOp, val: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{typ: tokEOF, pos: len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	kinds  map[string]Kind
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &Error{Column: tok.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// or := and ("||" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().typ == tokOp && p.peek().val == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// and := not ("&&" not)*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().typ == tokOp && p.peek().val == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// not := "!" not | primary
+func (p *parser) parseNot() (node, error) {
+	if p.peek().typ == tokOp && p.peek().val == "!" {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+// primary := "(" or ")" | field | field op value
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+
+	switch tok.typ {
+	case tokLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.next(); end.typ != tokRParen {
+			return nil, p.errorf(end, "expected \")\", got %s", end)
+		}
+		return x, nil
+
+	case tokIdent:
+		kind, exists := p.kinds[tok.val]
+		if !exists {
+			return nil, p.errorf(tok, "unknown field %q, valid fields are %s", tok.val, p.fieldNames())
+		}
+
+		// A boolean field can be used on its own
+		op := p.peek()
+		if op.typ != tokOp || !isComparison(op.val) {
+			if kind != Bool {
+				return nil, p.errorf(op, "expected a comparison after %s field %q, got %s", kind, tok.val, op)
+			}
+			return &boolNode{field: tok.val}, nil
+		}
+		p.next()
+
+		return p.parseComparison(tok.val, kind, op)
+
+	default:
+		return nil, p.errorf(tok, "expected a field name or \"(\", got %s", tok)
+	}
+}
+
+// Parses the value of a comparison and checks that it matches the kind of the field
+func (p *parser) parseComparison(field string, kind Kind, op token) (node, error) {
+	tok := p.next()
+	cmp := &cmpNode{field: field, kind: kind, op: op.val}
+
+	// Ordering only makes sense for numbers
+	if op.val != "==" && op.val != "!=" && kind != Number {
+		return nil, p.errorf(op, "%q can not be used on %s field %q", op.val, kind, field)
+	}
+
+	switch {
+	case tok.typ == tokString && (kind == String || kind == Match):
+		cmp.str = tok.val
+	case tok.typ == tokNumber && kind == Number:
+		num, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %q", tok.val)
+		}
+		cmp.num = num
+	case tok.typ == tokIdent && (tok.val == "true" || tok.val == "false") && kind == Bool:
+		cmp.boolean = tok.val == "true"
+	case tok.typ == tokEOF:
+		return nil, p.errorf(tok, "expected a value after %q", op.val)
+	default:
+		return nil, p.errorf(tok, "%s field %q can not be compared with %s", kind, field, tok)
+	}
+
+	return cmp, nil
+}
+
+// Returns a sorted list of the field names for use in error messages
+func (p *parser) fieldNames() string {
+	var names []string
+	for name := range p.kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+type node interface {
+	eval(values map[string]interface{}) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) eval(values map[string]interface{}) bool {
+	return n.left.eval(values) || n.right.eval(values)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) eval(values map[string]interface{}) bool {
+	return n.left.eval(values) && n.right.eval(values)
+}
+
+type notNode struct {
+	x node
+}
+
+func (n *notNode) eval(values map[string]interface{}) bool {
+	return !n.x.eval(values)
+}
+
+type boolNode struct {
+	field string
+}
+
+func (n *boolNode) eval(values map[string]interface{}) bool {
+	value, _ := values[n.field].(bool)
+	return value
+}
+
+type cmpNode struct {
+	field   string
+	kind    Kind
+	op      string
+	str     string
+	num     float64
+	boolean bool
+}
+
+func (n *cmpNode) eval(values map[string]interface{}) bool {
+	var equal bool
+
+	switch n.kind {
+	case String:
+		value, _ := values[n.field].(string)
+		equal = value == n.str
+	case Match:
+		match, _ := values[n.field].(func(string) bool)
+		equal = match != nil && match(n.str)
+	case Bool:
+		value, _ := values[n.field].(bool)
+		equal = value == n.boolean
+	case Number:
+		value, _ := values[n.field].(float64)
+		switch n.op {
+		case "<":
+			return value < n.num
+		case "<=":
+			return value <= n.num
+		case ">":
+			return value > n.num
+		case ">=":
+			return value >= n.num
+		}
+		equal = value == n.num
+	}
+
+	if n.op == "!=" {
+		return !equal
+	}
+	return equal
+}
@@ -0,0 +1,115 @@
+package where
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The fields used by the tests
+var testKinds = map[string]Kind{
+	"a":     Bool,
+	"b":     Bool,
+	"c":     Bool,
+	"numa":  Number,
+	"name":  String,
+	"class": Match,
+}
+
+// The values the expressions are evaluated against
+var testValues = map[string]interface{}{
+	"a":    true,
+	"b":    false,
+	"c":    false,
+	"numa": float64(1),
+	"name": "vfio-pci",
+	"class": func(class string) bool {
+		return strings.EqualFold(class, "VGA")
+	},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// && binds tighter than ||
+		{"a || b && c", true},
+		{"b && c || a", true},
+		{"b || a && c", false},
+		// ! only applies to the term after it
+		{"!a && b", false},
+		{"!b && a", true},
+		{"!!a", true},
+		// Parentheses override the precedence
+		{"(a || b) && c", false},
+		{"a || (b && c)", true},
+		{"!(a && b)", true},
+		{"((a))", true},
+		// Comparisons
+		{"numa == 1", true},
+		{"numa != 1", false},
+		{"numa < 2 && numa <= 1 && numa > 0 && numa >= 1", true},
+		{"numa > 1", false},
+		{"name == \"vfio-pci\"", true},
+		{"name == 'vfio-pci'", true},
+		{"name != \"nvidia\"", true},
+		{"a == true && b == false", true},
+		{"class == \"vga\"", true},
+		{"class != \"VGA\"", false},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.expr, testKinds)
+		if err != nil {
+			t.Errorf("Parse(%q) returned an error: %v", test.expr, err)
+			continue
+		}
+		if got := expr.Eval(testValues); got != test.want {
+			t.Errorf("Parse(%q).Eval() = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		column int
+		msg    string
+	}{
+		// Type errors
+		{"numa == \"one\"", 9, "can not be compared"},
+		{"name == 1", 9, "can not be compared"},
+		{"a == 1", 6, "can not be compared"},
+		{"name < \"x\"", 6, "can not be used on"},
+		{"class >= \"VGA\"", 7, "can not be used on"},
+		{"numa", 5, "expected a comparison"},
+		{"numa && a", 6, "expected a comparison"},
+		// Unknown fields
+		{"a && driver == \"x\"", 6, "unknown field"},
+		// Syntax errors
+		{"name == \"vfio", 9, "unterminated string"},
+		{"numa = 1", 6, "use \"==\""},
+		{"a && # b", 6, "unexpected character"},
+		{"(a || b", 8, "expected \")\""},
+		{"a b", 3, "unexpected"},
+		{"a &&", 5, "expected a field name"},
+		{"numa ==", 8, "expected a value"},
+		{"", 1, "expected a field name"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.expr, testKinds)
+		var parseErr *Error
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Parse(%q) returned %v, want a parse error", test.expr, err)
+			continue
+		}
+		if parseErr.Column != test.column {
+			t.Errorf("Parse(%q) error column = %d, want %d (%v)", test.expr, parseErr.Column, test.column, err)
+		}
+		if !strings.Contains(parseErr.Msg, test.msg) {
+			t.Errorf("Parse(%q) error = %q, want it to contain %q", test.expr, parseErr.Msg, test.msg)
+		}
+	}
+}